@@ -3,15 +3,19 @@ package main
 import (
 	"config"
 	"context"
+	"crypto/subtle"
 	"encoding/json"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"net"
 	"net/http"
 	"netctrl"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 )
 
@@ -42,20 +46,57 @@ func main() {
 	if len(c.VPNConfigurations) > 0 {
 		if err := ctr.SetVPN(&c.VPNConfigurations[0]); err != nil {
 			fmt.Printf("Failed to setup VPN %q: %v\n", c.VPNConfigurations[0].Name, err)
-			return
+			if !ctr.UplinkEnabled() {
+				return
+			}
+			// It is restarted once the uplink has an address.
+			fmt.Println("Waiting for the uplink to start the VPN")
 		}
 	}
 
 	for {
 		sig := waitInterrupt()
 		if sig == syscall.SIGHUP {
-			fmt.Println("Got SIGHUP")
+			fmt.Println("Got SIGHUP, reloading DNS filters")
+			ctr.ReloadDNSFilters()
 		} else {
 			return
 		}
 	}
 }
 
+// requireToken wraps a handler so it can only be used by presenting the
+// configured API token as a bearer token. If no token is configured, the
+// handler is disabled.
+func requireToken(c *config.Config, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if c.APIToken == "" {
+			http.Error(w, "api_token is not configured", http.StatusForbidden)
+			return
+		}
+		auth := req.Header.Get("Authorization")
+		if !strings.HasPrefix(auth, "Bearer ") || subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(c.APIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		h(w, req)
+	}
+}
+
+// mainNetworkOnly wraps a handler so it can only be used by clients of the
+// main network, such as to keep its passphrase from guests.
+func mainNetworkOnly(ctr *netctrl.Controller, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil || !ctr.OnMainNetwork(net.ParseIP(host)) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		h(w, req)
+	}
+}
+
 func makeServer(c *config.Config, ctr *netctrl.Controller) *http.Server {
 	http.Handle("/static/", http.StripPrefix("/static", http.FileServer(http.Dir("static"))))
 	http.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
@@ -71,11 +112,228 @@ func makeServer(c *config.Config, ctr *netctrl.Controller) *http.Server {
 		w.Write(d)
 	})
 
+	http.HandleFunc("/stations", func(w http.ResponseWriter, req *http.Request) {
+		d, _ := json.Marshal(ctr.Stations())
+		w.Write(d)
+	})
+
+	http.HandleFunc("/survey", func(w http.ResponseWriter, req *http.Request) {
+		d, _ := json.Marshal(ctr.Survey())
+		w.Write(d)
+	})
+	http.HandleFunc("/stations/acl", func(w http.ResponseWriter, req *http.Request) {
+		d, _ := json.Marshal(ctr.StationACL())
+		w.Write(d)
+	})
+	http.HandleFunc("/stations/kick", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var input struct {
+			MAC          string `json:"mac"`
+			Disassociate bool   `json:"disassociate"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ctr.KickStation(input.MAC, input.Disassociate); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	http.HandleFunc("/stations/ban", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		handleMACAction(w, req, ctr.BanStation)
+	}))
+	http.HandleFunc("/stations/unban", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		handleMACAction(w, req, ctr.UnbanStation)
+	}))
+	http.HandleFunc("/stations/allow", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		handleMACAction(w, req, ctr.AllowStation)
+	}))
+	http.HandleFunc("/stations/disallow", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		handleMACAction(w, req, ctr.DisallowStation)
+	}))
+
+	http.HandleFunc("/wireless", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var input netctrl.WirelessUpdate
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ctr.UpdateWireless(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+
+	http.HandleFunc("/wifi/qr.png", mainNetworkOnly(ctr, func(w http.ResponseWriter, req *http.Request) {
+		code, err := ctr.WifiQR(req.FormValue("network"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		scale, err := strconv.Atoi(req.FormValue("scale"))
+		if err != nil || scale <= 0 || scale > 32 {
+			scale = 8
+		}
+		d, err := code.PNG(scale)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(d)
+	}))
+	http.HandleFunc("/wifi/qr.svg", mainNetworkOnly(ctr, func(w http.ResponseWriter, req *http.Request) {
+		code, err := ctr.WifiQR(req.FormValue("network"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Write(code.SVG())
+	}))
+	http.HandleFunc("/wifi/wps", mainNetworkOnly(ctr, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := ctr.StartWPS(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	http.HandleFunc("/wifi/wps/cancel", mainNetworkOnly(ctr, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := ctr.CancelWPS(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+
+	http.HandleFunc("/uplink", func(w http.ResponseWriter, req *http.Request) {
+		uplink := ctr.Uplink()
+		if uplink == nil {
+			http.Error(w, "No uplink interface is configured", http.StatusNotFound)
+			return
+		}
+		d, _ := json.Marshal(uplink)
+		w.Write(d)
+	})
+	http.HandleFunc("/uplink/scan", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := ctr.ScanUplink(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+	http.HandleFunc("/uplink/connect", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var input struct {
+			SSID     string `json:"SSID"`
+			Password string `json:"password"`
+			Hidden   bool   `json:"hidden"`
+			Priority int    `json:"priority"`
+			Save     bool   `json:"save"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		n := &config.UplinkNetwork{SSID: input.SSID, Password: input.Password, Hidden: input.Hidden, Priority: input.Priority}
+		if err := ctr.ConnectUplink(n, input.Save); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	http.HandleFunc("/uplink/forget", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var input struct {
+			SSID string `json:"SSID"`
+		}
+		if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if err := ctr.ForgetUplink(input.SSID); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		}
+	}))
+	http.HandleFunc("/uplink/auto", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := ctr.AutoUplink(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	}))
+
 	http.HandleFunc("/vpns", func(w http.ResponseWriter, req *http.Request) {
 		d, _ := json.Marshal(c.VPNConfigurations)
 		w.Write(d)
 	})
 
+	http.HandleFunc("/dns/cache", func(w http.ResponseWriter, req *http.Request) {
+		d, _ := json.Marshal(ctr.DNSCacheStats())
+		w.Write(d)
+	})
+
+	http.HandleFunc("/dns/cache/flush", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		ctr.FlushDNSCache()
+	}))
+
+	http.HandleFunc("/dns/filters", func(w http.ResponseWriter, req *http.Request) {
+		d, _ := json.Marshal(ctr.DNSFilterStatus())
+		w.Write(d)
+	})
+
+	http.HandleFunc("/dns/queries", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		limit, err := strconv.Atoi(req.FormValue("limit"))
+		if err != nil || limit <= 0 {
+			limit = 100
+		}
+		queries, err := ctr.RecentQueries(req.FormValue("client"), limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		d, _ := json.Marshal(queries)
+		w.Write(d)
+	}))
+
+	http.HandleFunc("/dns/clients", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		top, err := strconv.Atoi(req.FormValue("top"))
+		if err != nil || top <= 0 {
+			top = 10
+		}
+		stats, err := ctr.QueryStats(top)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		d, _ := json.Marshal(stats)
+		w.Write(d)
+	}))
+
 	http.HandleFunc("/setVPN", func(w http.ResponseWriter, req *http.Request) {
 		if req.Method != http.MethodPost {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -109,6 +367,10 @@ func makeServer(c *config.Config, ctr *netctrl.Controller) *http.Server {
 	s := &http.Server{
 		Addr: c.Listener,
 	}
+	if ctr.CaptiveEnabled() {
+		registerPortalHandlers(c, ctr)
+		s.Handler = captiveHandler(c, ctr, http.DefaultServeMux)
+	}
 	return s
 }
 
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"config"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"netctrl"
+	"strings"
+)
+
+// captiveDetectionPaths are the paths operating systems probe to discover
+// whether they are behind a captive portal.
+var captiveDetectionPaths = map[string]bool{
+	"/generate_204":              true,
+	"/gen_204":                   true,
+	"/hotspot-detect.html":       true,
+	"/library/test/success.html": true,
+	"/ncsi.txt":                  true,
+	"/connecttest.txt":           true,
+	"/redirect":                  true,
+	"/success.txt":               true,
+	"/canonical.html":            true,
+}
+
+// captiveHandler restricts devices which have not been approved by the
+// captive portal to the portal pages, redirecting everything else there.
+func captiveHandler(c *config.Config, ctr *netctrl.Controller, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.RemoteAddr)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		_, approved, err := ctr.CaptiveClientByIP(net.ParseIP(host))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if approved {
+			next.ServeHTTP(w, req)
+			return
+		}
+
+		if req.URL.Path == "/portal" || strings.HasPrefix(req.URL.Path, "/portal/") || strings.HasPrefix(req.URL.Path, "/static/") {
+			next.ServeHTTP(w, req)
+			return
+		}
+		if captiveDetectionPaths[req.URL.Path] || req.Method == http.MethodGet {
+			http.Redirect(w, req, "http://"+portalHost(c)+"/portal", http.StatusFound)
+			return
+		}
+		http.Error(w, "Forbidden", http.StatusForbidden)
+	})
+}
+
+// portalHost returns the host:port the portal is served on.
+func portalHost(c *config.Config) string {
+	ip, _, _ := net.ParseCIDR(c.Network.Subnet)
+	_, port, _ := net.SplitHostPort(c.Listener)
+	return net.JoinHostPort(ip.String(), port)
+}
+
+func registerPortalHandlers(c *config.Config, ctr *netctrl.Controller) {
+	http.HandleFunc("/portal", func(w http.ResponseWriter, req *http.Request) {
+		d, _ := ioutil.ReadFile("static/portal.html")
+		w.Write(d)
+	})
+
+	http.HandleFunc("/portal/status", func(w http.ResponseWriter, req *http.Request) {
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		mac, approved, err := ctr.CaptiveClientByIP(net.ParseIP(host))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d, _ := json.Marshal(map[string]interface{}{
+			"name":     c.Name,
+			"mode":     c.CaptivePortal.Mode,
+			"terms":    c.CaptivePortal.Terms,
+			"mac":      mac,
+			"approved": approved,
+		})
+		w.Write(d)
+	})
+
+	http.HandleFunc("/portal/accept", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if c.CaptivePortal.Mode != "terms" {
+			http.Error(w, "Devices must be approved by an administrator", http.StatusForbidden)
+			return
+		}
+		host, _, _ := net.SplitHostPort(req.RemoteAddr)
+		mac, approved, err := ctr.CaptiveClientByIP(net.ParseIP(host))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if approved {
+			return
+		}
+		if err := ctr.CaptiveApprove(mac); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		}
+	})
+
+	http.HandleFunc("/captive/clients", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		d, _ := json.Marshal(ctr.CaptiveClients())
+		w.Write(d)
+	}))
+
+	http.HandleFunc("/captive/approve", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		handleMACAction(w, req, ctr.CaptiveApprove)
+	}))
+	http.HandleFunc("/captive/revoke", requireToken(c, func(w http.ResponseWriter, req *http.Request) {
+		handleMACAction(w, req, ctr.CaptiveRevoke)
+	}))
+}
+
+func handleMACAction(w http.ResponseWriter, req *http.Request, action func(mac string) error) {
+	if req.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var input struct {
+		MAC string `json:"mac"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&input); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := action(input.MAC); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
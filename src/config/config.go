@@ -2,7 +2,13 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"io/ioutil"
+	"math"
+	"net"
+	"net/url"
+	"strings"
+	"time"
 
 	"github.com/hashicorp/hcl"
 	"github.com/hashicorp/hcl/hcl/ast"
@@ -10,18 +16,98 @@ import (
 
 // Config stores configuration.
 type Config struct {
-	Name     string `hcl:"name"`
-	Listener string `hcl:"listener"`
+	Name      string `hcl:"name"`
+	Listener  string `hcl:"listener"`
+	StatePath string `hcl:"state_path"`
+	// APIToken must be presented as a bearer token to use API endpoints
+	// which act on devices. They are disabled if it is not set.
+	APIToken string `hcl:"api_token"`
+
+	// path is the file the configuration was loaded from.
+	path string
 
 	Network struct {
 		InterfaceIdent string `hcl:"interface_ident"`
 		Subnet         string `hcl:"subnet"`
-		Wireless       struct {
+		// WiredInterfaces are Ethernet ports added to the bridge, so
+		// clients plugged into them are served like wireless ones.
+		WiredInterfaces []string `hcl:"wired_interfaces"`
+		Wireless        struct {
 			Interface     string `hcl:"interface"`
 			SSID          string `hcl:"SSID"`
 			Password      string `hcl:"password"`
 			HostapdDriver string `hcl:"hostapd_driver"`
+
+			// Band is "2.4" or "5" (GHz). HWMode overrides the hw_mode
+			// hostapd would use for the band (a, b, g or ad).
+			Band   string `hcl:"band"`
+			HWMode string `hcl:"hw_mode"`
+			// Channel is the channel to use. If ACS is set, hostapd picks
+			// the least busy channel instead.
+			Channel int  `hcl:"channel"`
+			ACS     bool `hcl:"acs"`
+			// ChannelSurvey scans for other networks before starting the
+			// AP, and uses the least crowded channel allowed, falling back
+			// to Channel if the scan fails. With SurveyQuietHours, such as
+			// "02:00-05:00", the survey is repeated once a night while no
+			// stations are connected.
+			ChannelSurvey    bool   `hcl:"channel_survey"`
+			SurveyQuietHours string `hcl:"survey_quiet_hours"`
+			// CountryCode is the ISO 3166-1 country code, which determines
+			// the channels and power levels allowed.
+			CountryCode string `hcl:"country_code"`
+
+			// IEEE80211N and IEEE80211AC enable HT and VHT, with the given
+			// capabilities, such as "[HT40+][SHORT-GI-20]".
+			IEEE80211N      bool   `hcl:"ieee80211n"`
+			HTCapab         string `hcl:"ht_capab"`
+			IEEE80211AC     bool   `hcl:"ieee80211ac"`
+			VHTCapab        string `hcl:"vht_capab"`
+			VHTChannelWidth int    `hcl:"vht_oper_chwidth"`
+			VHTCenterFreq   int    `hcl:"vht_oper_centr_freq_seg0_idx"`
+			// WMM defaults to enabled when 802.11n or ac is.
+			WMM            *bool `hcl:"wmm"`
+			Hidden         bool  `hcl:"hidden"`
+			BeaconInterval int   `hcl:"beacon_interval"`
+
+			// Security is one of "wpa2", "wpa3" (SAE only), "wpa2-wpa3"
+			// (transition mode) or "open".
+			Security string `hcl:"security"`
+			// PMF (802.11w) is "disabled", "optional" or "required". It
+			// defaults to what the security mode needs.
+			PMF string `hcl:"pmf"`
+
+			// MACAllowlist only admits stations which have been allowed
+			// through the API.
+			MACAllowlist bool `hcl:"mac_allowlist"`
+
+			// QRCode serves a QR code for joining each network at
+			// /wifi/qr.png and /wifi/qr.svg. Anyone who can reach rnd can
+			// read the passphrase from it.
+			QRCode bool `hcl:"qr_code"`
+			// WPS enables push-button WPS on the main network. Each push
+			// lets devices join for WPSTimeout, up to 2 minutes.
+			WPS        bool   `hcl:"wps"`
+			WPSTimeout string `hcl:"wps_timeout"`
+
+			// HostapdOptions are added to the hostapd configuration as-is,
+			// for settings which are not otherwise supported.
+			HostapdOptions map[string]string `hcl:"hostapd_options"`
+
+			// Networks are additional SSIDs broadcast by the same radio,
+			// each with its own bridge, subnet and firewall policy.
+			Networks []WirelessNetwork `hcl:"networks"`
 		} `hcl:"wireless"`
+
+		// Uplink connects a second wireless interface to an upstream
+		// network as a client, which the VPN then runs over.
+		Uplink struct {
+			Interface string `hcl:"interface"`
+			// Networks are joined when in range, preferring the highest
+			// priority, then the strongest signal. More can be added
+			// through the API.
+			Networks []UplinkNetwork `hcl:"networks"`
+		} `hcl:"uplink"`
 	} `hcl:"network"`
 
 	Debug struct {
@@ -34,7 +120,79 @@ type Config struct {
 	Firewall struct {
 		VPNBoxBlockedPorts []int    `hcl:"vpnbox_blocked_ports"`
 		BlockedSubnets     []string `hcl:"blocked_subnets"`
+
+		// ForceDNS redirects all DNS from clients to the local resolver,
+		// and blocks DNS-over-TLS.
+		ForceDNS bool `hcl:"force_dns"`
+		// DOHBlockIPs and DOHBlockFile list public DNS-over-HTTPS servers
+		// to block when ForceDNS is set. The file has one IP or CIDR per line.
+		DOHBlockIPs  []string `hcl:"doh_block_ips"`
+		DOHBlockFile string   `hcl:"doh_block_file"`
 	} `hcl:"firewall"`
+
+	DNS struct {
+		Upstreams []DNSUpstream `hcl:"upstreams"`
+		// CacheSize is the maximum number of responses to cache.
+		CacheSize int `hcl:"cache_size"`
+		// UpstreamTimeout bounds how long a query may take to resolve.
+		UpstreamTimeout string `hcl:"upstream_timeout"`
+		// MaxInflightPerClient caps concurrent upstream queries per client.
+		MaxInflightPerClient int `hcl:"max_inflight_per_client"`
+		// AllowUplink permits upstream queries to leave over the uplink
+		// when the VPN is down. By default, they are pinned to the tunnel.
+		AllowUplink bool `hcl:"allow_uplink"`
+
+		Blocklists []DNSBlocklist `hcl:"blocklists"`
+		// Allowlist contains rules for names which are never blocked.
+		Allowlist []string `hcl:"allowlist"`
+		// BlockResponse is how blocked queries are answered: "nxdomain",
+		// "zero" (0.0.0.0 or ::) or "portal" (the address of rnd).
+		BlockResponse string `hcl:"block_response"`
+		// BlocklistRefresh is how often lists are reloaded, if set.
+		BlocklistRefresh string `hcl:"blocklist_refresh"`
+
+		// Records are answered locally, in preference to upstream.
+		Records []DNSRecord `hcl:"records"`
+		// LocalZones are domains answered entirely from Records. Names
+		// within them which are not configured do not exist.
+		LocalZones []string `hcl:"local_zones"`
+		// Forwards send queries for specific domains to other upstreams.
+		Forwards []DNSForward `hcl:"forward"`
+
+		// RebindProtection guards against DNS rebinding, by removing
+		// upstream answers pointing at private, loopback or link-local
+		// addresses. Forwarded domains are exempt.
+		RebindProtection struct {
+			Enabled bool `hcl:"enabled"`
+			// Action is "strip" to remove the offending records, or
+			// "refuse" to reject the whole response.
+			Action string `hcl:"action"`
+			// Allowlist contains rules for names which may resolve to
+			// private addresses.
+			Allowlist []string `hcl:"allowlist"`
+		} `hcl:"rebind_protection"`
+
+		QueryLog struct {
+			Enabled bool `hcl:"enabled"`
+			// Size is the number of recent queries kept in memory.
+			Size int `hcl:"size"`
+			// Anonymize replaces client IPs and MACs with pseudonyms.
+			Anonymize bool `hcl:"anonymize"`
+			// File, if set, is where queries are appended as JSON lines.
+			// It is rotated to File.1 when it exceeds MaxFileSizeMB.
+			File          string `hcl:"file"`
+			MaxFileSizeMB int    `hcl:"max_file_size_mb"`
+		} `hcl:"query_log"`
+	} `hcl:"dns"`
+
+	CaptivePortal struct {
+		Enabled bool `hcl:"enabled"`
+		// Mode is either "approve" (an admin must approve each device) or
+		// "terms" (the guest is approved once they accept the terms).
+		Mode             string `hcl:"mode"`
+		Terms            string `hcl:"terms"`
+		ApprovalDuration string `hcl:"approval_duration"`
+	} `hcl:"captive_portal"`
 }
 
 // VPNOpt represents one option for configuring the VPN.
@@ -45,6 +203,111 @@ type VPNOpt struct {
 
 	Username string `hcl:"username" json:"-"`
 	Password string `hcl:"password" json:"-"`
+
+	// DNSForwards apply only while this VPN is active, and take precedence
+	// over dns.forward rules.
+	DNSForwards []DNSForward `hcl:"dns_forward" json:"-"`
+	// UsePushedDNS forwards queries to the DNS servers pushed by the VPN
+	// server while this VPN is active. If PushedDNSFallback is set, the
+	// configured upstreams are used if those fail or none are pushed.
+	UsePushedDNS      bool `hcl:"use_pushed_dns" json:"-"`
+	PushedDNSFallback bool `hcl:"pushed_dns_fallback" json:"-"`
+}
+
+// WirelessNetwork describes an additional SSID and the network behind it.
+type WirelessNetwork struct {
+	// Name identifies the network in the API.
+	Name     string `hcl:"name" json:"name"`
+	SSID     string `hcl:"SSID" json:"SSID"`
+	Password string `hcl:"password" json:"-"`
+	// Security and PMF are as for the main network.
+	Security string `hcl:"security" json:"security"`
+	PMF      string `hcl:"pmf" json:"pmf"`
+	Hidden   bool   `hcl:"hidden" json:"hidden"`
+	// BSSID is the MAC address to broadcast the SSID with. hostapd derives
+	// one from the radio's address if not set.
+	BSSID string `hcl:"bssid" json:"bssid"`
+
+	Subnet string `hcl:"subnet" json:"subnet"`
+	// BlockedPorts are ports on rnd which clients cannot connect to, and
+	// BlockedSubnets are destinations they cannot reach. Networks can
+	// never reach each other.
+	BlockedPorts   []int    `hcl:"blocked_ports" json:"blocked_ports"`
+	BlockedSubnets []string `hcl:"blocked_subnets" json:"blocked_subnets"`
+
+	// VPN is the name of a VPN configuration to tunnel this network
+	// through, independently of the main network. If empty, traffic
+	// follows the main network's VPN.
+	VPN string `hcl:"vpn" json:"vpn"`
+}
+
+// UplinkNetwork describes an upstream network the uplink can join.
+type UplinkNetwork struct {
+	SSID string `hcl:"SSID" json:"SSID"`
+	// Password is empty for open networks.
+	Password string `hcl:"password" json:"-"`
+	Hidden   bool   `hcl:"hidden" json:"hidden"`
+	Priority int    `hcl:"priority" json:"priority"`
+}
+
+// Validate checks the SSID and password are usable.
+func (n *UplinkNetwork) Validate() error {
+	if n.SSID == "" || len(n.SSID) > 32 {
+		return fmt.Errorf("uplink network %q: SSID must be 1 to 32 bytes", n.SSID)
+	}
+	if n.Password != "" && (len(n.Password) < 8 || len(n.Password) > 63) {
+		return fmt.Errorf("uplink network %q: password must be 8 to 63 characters", n.SSID)
+	}
+	for _, r := range n.Password {
+		if r < 0x20 || r > 0x7e {
+			return fmt.Errorf("uplink network %q: password must contain only printable ASCII characters", n.SSID)
+		}
+	}
+	return nil
+}
+
+// DNSUpstream describes a resolver which DNS queries are forwarded to.
+type DNSUpstream struct {
+	Name string `hcl:"name" json:"name"`
+	// URL is either a https:// URL for DNS-over-HTTPS (RFC 8484), or a
+	// tls://host:port address for DNS-over-TLS.
+	URL string `hcl:"url" json:"url"`
+	// Bootstrap lists IPs the upstream host can be reached on, so no
+	// plaintext DNS lookup is needed to reach it. It is required unless the
+	// host is an IP address.
+	Bootstrap []string `hcl:"bootstrap" json:"bootstrap"`
+	// Method is the HTTP method used for DNS-over-HTTPS, GET or POST.
+	Method string `hcl:"method" json:"method"`
+}
+
+// DNSForward sends queries for names within Domains to a specific upstream,
+// instead of the default ones. As well as https:// and tls:// URLs, the URL
+// may be a plain IP[:port] or udp:// address for unencrypted DNS.
+type DNSForward struct {
+	DNSUpstream `hcl:",squash"`
+	// Domains lists the domains forwarded, including all their subdomains.
+	// A leading "*." is ignored.
+	Domains []string `hcl:"domains" json:"domains"`
+	// Uplink sends queries over the uplink rather than the VPN, such as
+	// to reach a resolver on the local network.
+	Uplink bool `hcl:"uplink" json:"uplink"`
+}
+
+// DNSRecord describes a static DNS record.
+type DNSRecord struct {
+	Name string `hcl:"name"`
+	Type string `hcl:"type"`
+	// Value is the record data in zone file format, such as an IP
+	// address, or "10 5 80 target.lab." for a SRV record.
+	Value string `hcl:"value"`
+	TTL   int    `hcl:"ttl"`
+}
+
+// DNSBlocklist describes a list of names to block, in hosts or adblock format.
+type DNSBlocklist struct {
+	Name string `hcl:"name" json:"name"`
+	// Source is a file path or http(s) URL.
+	Source string `hcl:"source" json:"source"`
 }
 
 func loadConfig(data []byte) (*Config, error) {
@@ -69,16 +332,338 @@ func loadConfig(data []byte) (*Config, error) {
 	if c.Network.Wireless.HostapdDriver == "" {
 		c.Network.Wireless.HostapdDriver = "nl80211"
 	}
+	if c.Network.Wireless.Band == "" {
+		c.Network.Wireless.Band = "2.4"
+	}
+	if c.Network.Wireless.Security == "" {
+		c.Network.Wireless.Security = "wpa2"
+	}
+	if c.Network.Wireless.BeaconInterval == 0 {
+		c.Network.Wireless.BeaconInterval = 100
+	}
+	if c.Network.Wireless.WPSTimeout == "" {
+		c.Network.Wireless.WPSTimeout = "2m"
+	}
+	for i := range c.Network.Wireless.Networks {
+		if c.Network.Wireless.Networks[i].Security == "" {
+			c.Network.Wireless.Networks[i].Security = "wpa2"
+		}
+	}
+	if len(c.DNS.Upstreams) == 0 {
+		c.DNS.Upstreams = []DNSUpstream{
+			{Name: "google", URL: "https://dns.google/dns-query", Bootstrap: []string{"8.8.8.8", "8.8.4.4"}},
+			{Name: "cloudflare", URL: "https://cloudflare-dns.com/dns-query", Bootstrap: []string{"1.1.1.1", "1.0.0.1"}},
+		}
+	}
+	if c.DNS.BlockResponse == "" {
+		c.DNS.BlockResponse = "nxdomain"
+	}
+	if c.DNS.RebindProtection.Action == "" {
+		c.DNS.RebindProtection.Action = "strip"
+	}
+	if c.DNS.QueryLog.Size == 0 {
+		c.DNS.QueryLog.Size = 10000
+	}
+	if c.DNS.QueryLog.MaxFileSizeMB == 0 {
+		c.DNS.QueryLog.MaxFileSizeMB = 10
+	}
+	if c.DNS.UpstreamTimeout == "" {
+		c.DNS.UpstreamTimeout = "5s"
+	}
+	if c.DNS.MaxInflightPerClient == 0 {
+		c.DNS.MaxInflightPerClient = 32
+	}
+	if c.DNS.CacheSize == 0 {
+		c.DNS.CacheSize = 4096
+	}
+	for i := range c.DNS.Upstreams {
+		if c.DNS.Upstreams[i].Method == "" {
+			c.DNS.Upstreams[i].Method = "POST"
+		}
+	}
+	for i := range c.DNS.Forwards {
+		setForwardDefaults(&c.DNS.Forwards[i].DNSUpstream, c.DNS.Forwards[i].Domains[0])
+	}
+	for i := range c.VPNConfigurations {
+		for j := range c.VPNConfigurations[i].DNSForwards {
+			f := &c.VPNConfigurations[i].DNSForwards[j]
+			setForwardDefaults(&f.DNSUpstream, f.Domains[0])
+		}
+	}
+	if c.StatePath == "" {
+		c.StatePath = "rnd-state.json"
+	}
+	if c.CaptivePortal.Mode == "" {
+		c.CaptivePortal.Mode = "approve"
+	}
+	if c.CaptivePortal.ApprovalDuration == "" {
+		c.CaptivePortal.ApprovalDuration = "168h"
+	}
 	return &c, nil
 }
 
+// setForwardDefaults fills in a forward's upstream, naming it after the
+// first domain forwarded.
+func setForwardDefaults(u *DNSUpstream, name string) {
+	if u.Method == "" {
+		u.Method = "POST"
+	}
+	if u.Name == "" {
+		u.Name = name
+	}
+}
+
 // LoadConfigFile loads configuration from the given file.
 func LoadConfigFile(fpath string) (*Config, error) {
 	d, err := ioutil.ReadFile(fpath)
 	if err != nil {
 		return nil, err
 	}
-	return loadConfig(d)
+	c, err := loadConfig(d)
+	if err != nil {
+		return nil, err
+	}
+	c.path = fpath
+	return c, nil
+}
+
+// Validate checks the configuration, as when it is loaded. It is used to
+// check settings changed at runtime.
+func (c *Config) Validate() error {
+	return validate(c)
+}
+
+// NetworkBridgeName returns the name of the bridge for the additional
+// network at index i.
+func NetworkBridgeName(c *Config, i int) string {
+	return fmt.Sprintf("br%s_%d", c.Network.InterfaceIdent, i+1)
+}
+
+// NetworkInterfaceName returns the name of the wireless interface hostapd
+// creates for the additional network at index i.
+func NetworkInterfaceName(c *Config, i int) string {
+	return fmt.Sprintf("%s_%d", c.Network.Wireless.Interface, i+1)
+}
+
+// NetworkTunnelName returns the name of the tunnel for the additional
+// network at index i, if it has its own VPN.
+func NetworkTunnelName(c *Config, i int) string {
+	return fmt.Sprintf("tun%s_%d", c.Network.InterfaceIdent, i+1)
+}
+
+// ParseTimeRange parses a range of times of day, such as "22:00-06:00",
+// returning the start and end as offsets from midnight.
+func ParseTimeRange(s string) (start, end time.Duration, err error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("%q must be a range such as 02:00-05:00", s)
+	}
+	var times [2]time.Duration
+	for i, p := range parts {
+		t, err := time.Parse("15:04", strings.TrimSpace(p))
+		if err != nil {
+			return 0, 0, fmt.Errorf("%q must be a range such as 02:00-05:00", s)
+		}
+		times[i] = time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute
+	}
+	if times[0] == times[1] {
+		return 0, 0, fmt.Errorf("%q is an empty range", s)
+	}
+	return times[0], times[1], nil
+}
+
+func validateSurvey(c *Config) error {
+	wl := &c.Network.Wireless
+	if !wl.ChannelSurvey {
+		if wl.SurveyQuietHours != "" {
+			return errors.New("network.wireless.survey_quiet_hours requires channel_survey")
+		}
+		return nil
+	}
+	if wl.ACS {
+		return errors.New("network.wireless.channel_survey and acs cannot both be set")
+	}
+	// The centre frequency would need to move with the channel.
+	if wl.VHTChannelWidth != 0 {
+		return errors.New("network.wireless.channel_survey cannot be used with vht_oper_chwidth")
+	}
+	if wl.SurveyQuietHours != "" {
+		if _, _, err := ParseTimeRange(wl.SurveyQuietHours); err != nil {
+			return fmt.Errorf("network.wireless.survey_quiet_hours: %v", err)
+		}
+	}
+	return nil
+}
+
+func validateWired(c *Config) error {
+	if c.Network.Wireless.Interface == "" && len(c.Network.WiredInterfaces) == 0 {
+		return errors.New("network.wireless.interface or network.wired_interfaces must be specified")
+	}
+	if wl := &c.Network.Wireless; wl.Interface == "" && (wl.WPS || wl.QRCode || wl.ChannelSurvey) {
+		return errors.New("network.wireless.wps, qr_code and channel_survey require network.wireless.interface")
+	}
+	seen := map[string]bool{}
+	for _, iface := range c.Network.WiredInterfaces {
+		if iface == "" {
+			return errors.New("network.wired_interfaces cannot contain an empty name")
+		}
+		if iface == c.Network.Wireless.Interface {
+			return fmt.Errorf("network.wired_interfaces: %s is the wireless interface", iface)
+		}
+		if seen[iface] {
+			return fmt.Errorf("network.wired_interfaces: %s is listed more than once", iface)
+		}
+		seen[iface] = true
+	}
+	return nil
+}
+
+func validateUplink(c *Config) error {
+	u := &c.Network.Uplink
+	if u.Interface == "" {
+		if len(u.Networks) > 0 {
+			return errors.New("network.uplink.networks requires network.uplink.interface")
+		}
+		return nil
+	}
+	if u.Interface == c.Network.Wireless.Interface {
+		return errors.New("network.uplink.interface must not be the wireless interface")
+	}
+	for _, iface := range c.Network.WiredInterfaces {
+		if u.Interface == iface {
+			return errors.New("network.uplink.interface must not be a wired interface")
+		}
+	}
+	seen := map[string]bool{}
+	for i := range u.Networks {
+		if err := u.Networks[i].Validate(); err != nil {
+			return err
+		}
+		if seen[u.Networks[i].SSID] {
+			return fmt.Errorf("uplink network %q is defined more than once", u.Networks[i].SSID)
+		}
+		seen[u.Networks[i].SSID] = true
+	}
+	return nil
+}
+
+func validateNetworks(c *Config) error {
+	_, mainSubnet, err := net.ParseCIDR(c.Network.Subnet)
+	if err != nil {
+		return fmt.Errorf("network.subnet: %v", err)
+	}
+	subnets := []*net.IPNet{mainSubnet}
+	names := map[string]bool{}
+	for i, n := range c.Network.Wireless.Networks {
+		if n.Name == "" || n.SSID == "" || n.Subnet == "" {
+			return fmt.Errorf("network.wireless.networks[%d] must specify a name, SSID and subnet", i)
+		}
+		if names[n.Name] {
+			return fmt.Errorf("network %q is defined more than once", n.Name)
+		}
+		names[n.Name] = true
+		if c.Network.Wireless.Interface == "" {
+			return fmt.Errorf("network %q: network.wireless.interface must be specified", n.Name)
+		}
+		// Linux limits interface names to 15 characters.
+		if len(NetworkTunnelName(c, i)) > 15 {
+			return fmt.Errorf("network %q: network.interface_ident is too long for additional networks", n.Name)
+		}
+		if len(NetworkInterfaceName(c, i)) > 15 {
+			return fmt.Errorf("network %q: network.wireless.interface is too long for additional networks", n.Name)
+		}
+
+		ip, subnet, err := net.ParseCIDR(n.Subnet)
+		if err != nil {
+			return fmt.Errorf("network %q: subnet: %v", n.Name, err)
+		}
+		if ip.To4() == nil {
+			return fmt.Errorf("network %q: subnet must be IPv4", n.Name)
+		}
+		for _, other := range subnets {
+			if other.Contains(subnet.IP) || subnet.Contains(other.IP) {
+				return fmt.Errorf("network %q: subnet %s overlaps %s", n.Name, subnet, other)
+			}
+		}
+		subnets = append(subnets, subnet)
+		for _, s := range n.BlockedSubnets {
+			if _, _, err := net.ParseCIDR(s); err != nil && net.ParseIP(s) == nil {
+				return fmt.Errorf("network %q: invalid blocked subnet %q", n.Name, s)
+			}
+		}
+		for _, p := range n.BlockedPorts {
+			if p < 1 || p > 65535 {
+				return fmt.Errorf("network %q: invalid blocked port %d", n.Name, p)
+			}
+		}
+		if n.BSSID != "" {
+			if _, err := net.ParseMAC(n.BSSID); err != nil {
+				return fmt.Errorf("network %q: bssid: %v", n.Name, err)
+			}
+		}
+
+		if n.VPN != "" {
+			found := false
+			for _, v := range c.VPNConfigurations {
+				found = found || v.Name == n.VPN
+			}
+			if !found {
+				return fmt.Errorf("network %q: no VPN configuration named %q", n.Name, n.VPN)
+			}
+		}
+	}
+	return nil
+}
+
+func validateUpstream(u *DNSUpstream) error {
+	if u.Method != "" && u.Method != "GET" && u.Method != "POST" {
+		return errors.New("method must be GET or POST")
+	}
+	for _, ip := range u.Bootstrap {
+		if net.ParseIP(ip) == nil {
+			return fmt.Errorf("invalid bootstrap IP %q", ip)
+		}
+	}
+	if strings.HasPrefix(u.URL, "https://") || strings.HasPrefix(u.URL, "tls://") {
+		parsed, err := url.Parse(u.URL)
+		if err != nil {
+			return fmt.Errorf("url: %v", err)
+		}
+		if parsed.Hostname() == "" {
+			return fmt.Errorf("url %q has no host", u.URL)
+		}
+		if net.ParseIP(parsed.Hostname()) == nil && len(u.Bootstrap) == 0 {
+			return fmt.Errorf("bootstrap IPs must be given for %s, so it is not looked up over plaintext DNS", parsed.Hostname())
+		}
+	}
+	return nil
+}
+
+func validateForward(f *DNSForward) error {
+	if len(f.Domains) == 0 {
+		return errors.New("domains must be specified")
+	}
+	for _, d := range f.Domains {
+		if strings.Trim(strings.TrimPrefix(d, "*."), ".") == "" {
+			return fmt.Errorf("invalid domain %q", d)
+		}
+	}
+	switch {
+	case f.URL == "":
+		return errors.New("url must be specified")
+	case strings.HasPrefix(f.URL, "https://"), strings.HasPrefix(f.URL, "tls://"):
+	default:
+		// Plain DNS must be addressed by IP, as there is nothing to
+		// resolve the name with.
+		host := strings.TrimPrefix(f.URL, "udp://")
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if net.ParseIP(host) == nil {
+			return fmt.Errorf("url %q must be an IP address, or start with udp://, tls:// or https://", f.URL)
+		}
+	}
+	return validateUpstream(&f.DNSUpstream)
 }
 
 func validate(c *Config) error {
@@ -91,5 +676,107 @@ func validate(c *Config) error {
 	if c.Network.Subnet == "" {
 		return errors.New("network.subnet must be specified")
 	}
+	if err := validateWired(c); err != nil {
+		return err
+	}
+	if err := validateUplink(c); err != nil {
+		return err
+	}
+	if err := validateNetworks(c); err != nil {
+		return err
+	}
+	if c.Network.Wireless.WPSTimeout != "" {
+		if d, err := time.ParseDuration(c.Network.Wireless.WPSTimeout); err != nil || d <= 0 || d > 2*time.Minute {
+			return errors.New("network.wireless.wps_timeout must be a duration of up to 2m")
+		}
+	}
+	if err := validateSurvey(c); err != nil {
+		return err
+	}
+	for _, ip := range c.Firewall.DOHBlockIPs {
+		if net.ParseIP(ip) == nil {
+			if _, _, err := net.ParseCIDR(ip); err != nil {
+				return fmt.Errorf("firewall.doh_block_ips: invalid address %q", ip)
+			}
+		}
+	}
+	for i, u := range c.DNS.Upstreams {
+		if u.Name == "" {
+			return fmt.Errorf("dns.upstreams[%d].name must be specified", i)
+		}
+		if !strings.HasPrefix(u.URL, "https://") && !strings.HasPrefix(u.URL, "tls://") {
+			return fmt.Errorf("dns upstream %q: url must start with https:// or tls://", u.Name)
+		}
+		if err := validateUpstream(&u); err != nil {
+			return fmt.Errorf("dns upstream %q: %v", u.Name, err)
+		}
+	}
+	for i, f := range c.DNS.Forwards {
+		if err := validateForward(&f); err != nil {
+			return fmt.Errorf("dns.forward[%d]: %v", i, err)
+		}
+	}
+	for _, v := range c.VPNConfigurations {
+		for i, f := range v.DNSForwards {
+			if err := validateForward(&f); err != nil {
+				return fmt.Errorf("vpn config %q: dns_forward[%d]: %v", v.Name, i, err)
+			}
+		}
+	}
+	for i, l := range c.DNS.Blocklists {
+		if l.Name == "" || l.Source == "" {
+			return fmt.Errorf("dns.blocklists[%d] must specify a name and source", i)
+		}
+	}
+	for i, r := range c.DNS.Records {
+		if r.Name == "" || r.Value == "" {
+			return fmt.Errorf("dns.records[%d] must specify a name and value", i)
+		}
+		switch strings.ToUpper(r.Type) {
+		case "A", "AAAA", "CNAME", "TXT", "SRV", "MX", "PTR":
+		default:
+			return fmt.Errorf("dns record %q: unsupported type %q", r.Name, r.Type)
+		}
+		if r.TTL < 0 || int64(r.TTL) > math.MaxUint32 {
+			return fmt.Errorf("dns record %q: invalid ttl %d", r.Name, r.TTL)
+		}
+	}
+	switch c.DNS.BlockResponse {
+	case "", "nxdomain", "zero", "portal":
+	default:
+		return errors.New("dns.block_response must be one of nxdomain, zero or portal")
+	}
+	switch c.DNS.RebindProtection.Action {
+	case "", "strip", "refuse":
+	default:
+		return errors.New("dns.rebind_protection.action must be either strip or refuse")
+	}
+	if c.DNS.BlocklistRefresh != "" {
+		if _, err := time.ParseDuration(c.DNS.BlocklistRefresh); err != nil {
+			return fmt.Errorf("dns.blocklist_refresh: %v", err)
+		}
+	}
+	if c.DNS.QueryLog.Size < 0 || c.DNS.QueryLog.MaxFileSizeMB < 0 {
+		return errors.New("dns.query_log sizes cannot be negative")
+	}
+	if c.DNS.UpstreamTimeout != "" {
+		if d, err := time.ParseDuration(c.DNS.UpstreamTimeout); err != nil || d <= 0 {
+			return errors.New("dns.upstream_timeout must be a positive duration")
+		}
+	}
+	if c.DNS.MaxInflightPerClient < 0 {
+		return errors.New("dns.max_inflight_per_client cannot be negative")
+	}
+	if c.DNS.CacheSize < 0 {
+		return errors.New("dns.cache_size cannot be negative")
+	}
+	if c.CaptivePortal.Mode != "" && c.CaptivePortal.Mode != "approve" && c.CaptivePortal.Mode != "terms" {
+		return errors.New("captive_portal.mode must be either approve or terms")
+	}
+	if c.CaptivePortal.ApprovalDuration != "" {
+		if _, err := time.ParseDuration(c.CaptivePortal.ApprovalDuration); err != nil {
+			return fmt.Errorf("captive_portal.approval_duration: %v", err)
+		}
+	}
 	return nil
 }
@@ -0,0 +1,139 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/hcl/hcl/ast"
+	"github.com/hashicorp/hcl/hcl/parser"
+	"github.com/hashicorp/hcl/hcl/printer"
+	"github.com/hashicorp/hcl/hcl/token"
+)
+
+// UpdateFile writes settings back to the file the configuration was loaded
+// from. Settings are keyed by their dotted path, such as
+// "network.wireless.SSID", and are added if not already present. The rest
+// of the file, including comments, is kept.
+func (c *Config) UpdateFile(settings map[string]interface{}) error {
+	if c.path == "" {
+		return errors.New("configuration was not loaded from a file")
+	}
+	d, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	f, err := parser.Parse(d)
+	if err != nil {
+		return err
+	}
+	root, ok := f.Node.(*ast.ObjectList)
+	if !ok {
+		return errors.New("unexpected configuration structure")
+	}
+	for path, v := range settings {
+		lit, err := literal(v)
+		if err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if err := setPath(root, strings.Split(path, "."), lit); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	var out bytes.Buffer
+	if err := printer.Fprint(&out, f); err != nil {
+		return err
+	}
+	out.WriteString("\n")
+	return writeFileAtomic(c.path, out.Bytes())
+}
+
+func literal(v interface{}) (*ast.LiteralType, error) {
+	switch v := v.(type) {
+	case string:
+		return &ast.LiteralType{Token: token.Token{Type: token.STRING, Text: strconv.Quote(v)}}, nil
+	case bool:
+		return &ast.LiteralType{Token: token.Token{Type: token.BOOL, Text: strconv.FormatBool(v)}}, nil
+	case int:
+		return &ast.LiteralType{Token: token.Token{Type: token.NUMBER, Text: strconv.Itoa(v)}}, nil
+	}
+	return nil, fmt.Errorf("unsupported type %T", v)
+}
+
+// setPath sets the item at path within list, creating any objects along
+// the way.
+func setPath(list *ast.ObjectList, path []string, val *ast.LiteralType) error {
+	var item *ast.ObjectItem
+	for _, i := range list.Items {
+		if len(i.Keys) == 1 && keyText(i.Keys[0]) == path[0] {
+			item = i
+		}
+	}
+	if item == nil {
+		item = &ast.ObjectItem{
+			Keys:   []*ast.ObjectKey{{Token: token.Token{Type: token.IDENT, Text: path[0]}}},
+			Assign: token.Pos{Line: 1},
+		}
+		if len(path) > 1 {
+			item.Val = &ast.ObjectType{List: &ast.ObjectList{}}
+		}
+		list.Add(item)
+	}
+
+	if len(path) == 1 {
+		// Keep any comment on the line being replaced.
+		if old, ok := item.Val.(*ast.LiteralType); ok {
+			val.Token.Pos = old.Token.Pos
+			val.LineComment = old.LineComment
+		}
+		item.Val = val
+		return nil
+	}
+	obj, ok := item.Val.(*ast.ObjectType)
+	if !ok {
+		return fmt.Errorf("%s is not an object", path[0])
+	}
+	return setPath(obj.List, path[1:], val)
+}
+
+func keyText(k *ast.ObjectKey) string {
+	if k.Token.Type == token.STRING {
+		if s, err := strconv.Unquote(k.Token.Text); err == nil {
+			return s
+		}
+	}
+	return k.Token.Text
+}
+
+// writeFileAtomic replaces the file at path, keeping its permissions.
+func writeFileAtomic(path string, d []byte) error {
+	st, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(path), ".rnd-config")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Chmod(st.Mode().Perm()); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
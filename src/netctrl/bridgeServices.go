@@ -1,10 +1,10 @@
 package netctrl
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
 	"net"
-	"net/http"
+	"sync"
 	"time"
 
 	dhcp "github.com/krolaw/dhcp4"
@@ -12,14 +12,35 @@ import (
 )
 
 type bridgeServices struct {
-	name         string
 	debug        bool
 	baseIP, next net.IP
+	leaseLock    sync.Mutex
 	leases       map[string]net.IP
 	options      dhcp.Options // Options to send to DHCP Clients
+
+	local         *localRecords
+	upstreams     func() *upstreamPool
+	forwarder     *dnsForwarder
+	cache         *dnsCache
+	filter        *dnsFilter
+	blockResponse string
+	rebind        *rebindProtection
+	queryLog      *queryLog
+	timeout       time.Duration
+	limiter       *clientLimiter
+	inflight      inflightGroup
+	// upstreamAllowed returns false if queries must not be sent upstream,
+	// such as when the VPN is down.
+	upstreamAllowed func() bool
+
+	portalIP net.IP
+	captive  *captivePortal
 }
 
 func (h *bridgeServices) ServeDHCP(p dhcp.Packet, msgType dhcp.MessageType, options dhcp.Options) (d dhcp.Packet) {
+	h.leaseLock.Lock()
+	defer h.leaseLock.Unlock()
+
 	if h.debug {
 		fmt.Printf("DHCP msg %q from %q\n", msgType.String(), p.CHAddr().String())
 		fmt.Printf("Leases: %+v\nNext address: %+v\nBase address: %+v\n", h.leases, h.next, h.baseIP)
@@ -77,92 +98,243 @@ func (h *bridgeServices) setupUDPDNS(listenerIP string) error {
 		return err
 	}
 
-	server := &dns.Server{PacketConn: listener, Handler: h, ReadTimeout: time.Second, WriteTimeout: time.Second}
+	server := &dns.Server{PacketConn: listener, Handler: h, UDPSize: dns.DefaultMsgSize, ReadTimeout: time.Second, WriteTimeout: time.Second}
 	go server.ActivateAndServe()
 	return nil
 }
 
 // ServeDNS handles DNS requests.
 func (h *bridgeServices) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	start := time.Now()
+	client := remoteIP(w)
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+
+	var m *dns.Msg
+	source := sourceCaptive
+	if h.captive != nil {
+		m = h.captiveResponse(client, r)
+	}
+	if m == nil {
+		switch len(r.Question) {
+		case 0:
+			m = new(dns.Msg)
+			m.SetRcode(r, dns.RcodeFormatError)
+			source = sourceError
+		case 1:
+			m, source = h.resolve(ctx, client, r)
+		default:
+			m, source = h.resolveEach(ctx, client, r)
+		}
+	}
+
+	m.Id = r.Id
+	if _, isUDP := w.RemoteAddr().(*net.UDPAddr); isUDP {
+		truncate(m, udpResponseSize(r))
+	}
+	w.WriteMsg(m)
+
+	if h.queryLog != nil {
+		h.queryLog.Record(client.String(), h.clientMAC(client), r, m, time.Since(start), source)
+	}
+}
+
+// resolve answers a query containing a single question, either from local
+// names or by forwarding the query upstream unmodified. The source of the
+// answer is also returned.
+func (h *bridgeServices) resolve(ctx context.Context, client net.IP, r *dns.Msg) (*dns.Msg, string) {
+	q := r.Question[0]
 	m := new(dns.Msg)
 	m.SetReply(r)
+	m.RecursionAvailable = true
 
-	for _, q := range r.Question {
-		switch q.Name {
-		case h.name + ".":
-			m.Answer = append(m.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60},
-				A:   h.baseIP,
-			})
-		case "googleDNS.":
-			m.Answer = append(m.Answer, &dns.A{
-				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
-				A:   net.ParseIP("8.8.8.8"),
-			})
-		default:
-			resp, err := http.Get("https://dns.google.com/resolve?name=" + q.Name + "&type=" + fmt.Sprintf("%d", q.Qtype))
-			if err != nil {
-				fmt.Printf("Failed to lookup DNS for %v: %v\n", q.Name, err)
-				continue
-			}
-			var response dnsResponse
-			if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
-				fmt.Printf("Failed to decode DNS response for %v: %v\n", q.Name, err)
-				continue
-			}
-			for _, a := range response.Answer {
-				switch a.Type {
-				case dns.TypeA:
-					m.Answer = append(m.Answer, &dns.A{
-						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: a.TTL},
-						A:   net.ParseIP(a.Data),
-					})
-				case dns.TypeAAAA:
-					m.Answer = append(m.Answer, &dns.AAAA{
-						Hdr:  dns.RR_Header{Name: q.Name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: a.TTL},
-						AAAA: net.ParseIP(a.Data),
-					})
-				case dns.TypeNS:
-					m.Answer = append(m.Answer, &dns.NS{
-						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: a.TTL},
-						Ns:  a.Data,
-					})
-				case dns.TypeCNAME:
-					m.Answer = append(m.Answer, &dns.CNAME{
-						Hdr:    dns.RR_Header{Name: q.Name, Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: a.TTL},
-						Target: a.Data,
-					})
-				case dns.TypeTXT:
-					m.Answer = append(m.Answer, &dns.TXT{
-						Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: a.TTL},
-						Txt: []string{a.Data},
-					})
-				}
-			}
+	if resp := h.local.Answer(r); resp != nil {
+		return resp, sourceLocal
+	}
+
+	if h.filter.Blocked(q.Name) {
+		return blockedResponse(r, h.blockResponse, h.portalIP), sourceBlocked
+	}
+
+	if resp, prefetch := h.cache.Get(r); resp != nil {
+		if prefetch {
+			go h.prefetch(r.Copy())
 		}
+		return h.protectRebind(r, resp, sourceCache)
 	}
 
-	m.RecursionDesired = false
+	upstreams := h.upstreamsFor(r)
+	if upstreams == nil {
+		m.SetRcode(r, dns.RcodeServerFailure)
+		return m, sourceRefused
+	}
+	resp, err := h.exchange(ctx, client, upstreams, r)
+	if err != nil {
+		fmt.Printf("Failed to lookup DNS for %v: %v\n", q.Name, err)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		return m, sourceError
+	}
+	return h.protectRebind(r, resp, sourceUpstream)
+}
+
+// protectRebind applies DNS rebinding protection to an upstream response,
+// if enabled. Names with a forwarding rule are exempt, as they are expected
+// to resolve to internal addresses.
+func (h *bridgeServices) protectRebind(r, resp *dns.Msg, source string) (*dns.Msg, string) {
+	name := r.Question[0].Name
+	if h.rebind == nil || h.forwarder.Match(name) != nil {
+		return resp, source
+	}
+	if h.rebind.Filter(name, resp) {
+		return resp, sourceRebind
+	}
+	return resp, source
+}
+
+// upstreamsFor returns the upstreams a query should be forwarded to, or nil
+// if it cannot be sent upstream at the moment. Queries matching a forwarding
+// rule over the uplink may be sent even while the VPN is down.
+func (h *bridgeServices) upstreamsFor(r *dns.Msg) *upstreamPool {
+	if rule := h.forwarder.Match(r.Question[0].Name); rule != nil {
+		if rule.uplink || h.upstreamAllowed() {
+			return rule.pool
+		}
+		return nil
+	}
+	if h.upstreamAllowed() {
+		return h.upstreams()
+	}
+	return nil
+}
+
+// exchange forwards a query upstream and caches the response. Identical
+// queries already in flight are waited on rather than sent again. The query
+// sent is shared by every client waiting for it, so is not cancelled if the
+// client which sent it goes away, only once the upstream timeout passes.
+func (h *bridgeServices) exchange(ctx context.Context, client net.IP, upstreams *upstreamPool, r *dns.Msg) (*dns.Msg, error) {
+	release, err := h.limiter.Acquire(ctx, client.String())
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	resp, err := h.inflight.Do(ctx, cacheKeyFor(r), func() (*dns.Msg, error) {
+		ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+		defer cancel()
+		resp, err := upstreams.Exchange(ctx, r)
+		if err == nil {
+			h.cache.Put(r, resp)
+		}
+		return resp, err
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp = resp.Copy()
+	resp.Id = r.Id
+	return resp, nil
+}
+
+// prefetch refreshes the cached response to a query before it expires.
+func (h *bridgeServices) prefetch(r *dns.Msg) {
+	upstreams := h.upstreamsFor(r)
+	if upstreams == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), h.timeout)
+	defer cancel()
+	resp, err := upstreams.Exchange(ctx, r)
+	if err != nil {
+		fmt.Printf("Failed to prefetch DNS for %v: %v\n", r.Question[0].Name, err)
+		return
+	}
+	h.cache.Put(r, resp)
+}
+
+// resolveEach answers a query containing multiple questions, by resolving
+// each question concurrently and merging the responses. The source of the
+// answer to the first question is returned.
+func (h *bridgeServices) resolveEach(ctx context.Context, client net.IP, r *dns.Msg) (*dns.Msg, string) {
+	m := new(dns.Msg)
+	m.SetReply(r)
 	m.RecursionAvailable = true
-	w.WriteMsg(m)
+	m.AuthenticatedData = true
+
+	responses := make([]*dns.Msg, len(r.Question))
+	sources := make([]string, len(r.Question))
+	var wg sync.WaitGroup
+	for i, q := range r.Question {
+		sub := r.Copy()
+		sub.Question = []dns.Question{q}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			responses[i], sources[i] = h.resolve(ctx, client, sub)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, resp := range responses {
+		if m.Rcode == dns.RcodeSuccess {
+			m.Rcode = resp.Rcode
+		}
+		m.AuthenticatedData = m.AuthenticatedData && resp.AuthenticatedData
+		m.Answer = append(m.Answer, resp.Answer...)
+		m.Ns = append(m.Ns, resp.Ns...)
+		for _, rr := range resp.Extra {
+			if rr.Header().Rrtype != dns.TypeOPT {
+				m.Extra = append(m.Extra, rr)
+			}
+		}
+	}
+
+	if opt := r.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	return m, sources[0]
 }
 
-type dnsResponse struct {
-	Status     int32         `json:"Status,omitempty"`
-	Question   []dnsQuestion `json:"Question,omitempty"`
-	Answer     []dnsRecord   `json:"Answer,omitempty"`
-	Authority  []dnsRecord   `json:"Authority,omitempty"`
-	Additional []dnsRecord   `json:"Additional,omitempty"`
+// captiveResponse answers queries from devices which have not been approved
+// by the captive portal with the portal address. nil is returned for
+// approved devices.
+func (h *bridgeServices) captiveResponse(client net.IP, r *dns.Msg) *dns.Msg {
+	if _, approved, err := h.captive.ClientByIP(client); err == nil && approved {
+		return nil
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	for _, q := range m.Question {
+		if q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{
+				Hdr: dns.RR_Header{Name: q.Name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+				A:   h.portalIP,
+			})
+		}
+	}
+	m.RecursionAvailable = true
+	return m
 }
 
-type dnsQuestion struct {
-	Name string `json:"name,omitempty"`
-	Type int32  `json:"type,omitempty"`
+// clientMAC returns the MAC address leased the given IP, if any.
+func (h *bridgeServices) clientMAC(ip net.IP) string {
+	h.leaseLock.Lock()
+	defer h.leaseLock.Unlock()
+	for mac, leased := range h.leases {
+		if leased.Equal(ip) {
+			return mac
+		}
+	}
+	return ""
 }
 
-type dnsRecord struct {
-	Name string `json:"name,omitempty"`
-	Type uint16 `json:"type,omitempty"`
-	TTL  uint32 `json:"TTL,omitempty"`
-	Data string `json:"data,omitempty"`
+// remoteIP returns the IP address of the client which sent a DNS query.
+func remoteIP(w dns.ResponseWriter) net.IP {
+	switch addr := w.RemoteAddr().(type) {
+	case *net.UDPAddr:
+		return addr.IP
+	case *net.TCPAddr:
+		return addr.IP
+	}
+	return nil
 }
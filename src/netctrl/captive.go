@@ -0,0 +1,285 @@
+package netctrl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const captiveChain = "rnd-captive"
+
+var errCaptiveDisabled = errors.New("captive portal is not enabled")
+
+// CaptiveClient describes a device known to the captive portal.
+type CaptiveClient struct {
+	MAC       string    `json:"mac"`
+	Approved  bool      `json:"approved"`
+	Expires   time.Time `json:"expires,omitempty"`
+	FirstSeen time.Time `json:"first_seen,omitempty"`
+}
+
+// captivePortal firewalls devices which have not been approved, so they
+// can only reach the portal on the web server.
+type captivePortal struct {
+	lock     sync.Mutex
+	ipt      *iptables.IPTables
+	state    *persistentState
+	bridge   *net.Interface
+	duration time.Duration
+
+	// pending tracks unapproved devices which have tried to use the network.
+	pending map[string]time.Time
+}
+
+func newCaptivePortal(ipt *iptables.IPTables, state *persistentState, bridge *net.Interface, portalIP net.IP, portalPort string, duration time.Duration) (*captivePortal, error) {
+	p := &captivePortal{
+		ipt:      ipt,
+		state:    state,
+		bridge:   bridge,
+		duration: duration,
+		pending:  map[string]time.Time{},
+	}
+
+	for _, table := range []string{"filter", "nat"} {
+		if err := ipt.ClearChain(table, captiveChain); err != nil {
+			return nil, err
+		}
+	}
+	if err := ipt.Append("filter", captiveChain, "-j", "DROP"); err != nil {
+		return nil, err
+	}
+	if err := ipt.Append("nat", captiveChain, "-p", "tcp", "--dport", "80", "-j", "DNAT", "--to-destination", portalIP.String()+":"+portalPort); err != nil {
+		return nil, err
+	}
+	if err := ipt.Insert("filter", "FORWARD", 1, "-i", bridge.Name, "-j", captiveChain); err != nil {
+		return nil, err
+	}
+	if err := ipt.Insert("nat", "PREROUTING", 1, "-i", bridge.Name, "-j", captiveChain); err != nil {
+		return nil, err
+	}
+
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+	for mac, exp := range p.state.Approvals {
+		if time.Now().After(exp) {
+			delete(p.state.Approvals, mac)
+			continue
+		}
+		if err := p.allow(mac); err != nil {
+			return nil, err
+		}
+	}
+	return p, p.state.save()
+}
+
+// allow lifts the firewall for the given MAC.
+func (p *captivePortal) allow(mac string) error {
+	for _, table := range []string{"filter", "nat"} {
+		if err := p.ipt.Insert(table, captiveChain, 1, "-m", "mac", "--mac-source", mac, "-j", "RETURN"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// disallow reinstates the firewall for the given MAC.
+func (p *captivePortal) disallow(mac string) error {
+	for _, table := range []string{"filter", "nat"} {
+		if err := p.ipt.Delete(table, captiveChain, "-m", "mac", "--mac-source", mac, "-j", "RETURN"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Approve lifts the firewall for the given MAC until the approval expires.
+func (p *captivePortal) Approve(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	mac = hw.String()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+
+	if _, approved := p.state.Approvals[mac]; !approved {
+		if err := p.allow(mac); err != nil {
+			return err
+		}
+	}
+	delete(p.pending, mac)
+	p.state.Approvals[mac] = time.Now().Add(p.duration)
+	return p.state.save()
+}
+
+// Revoke removes the approval for the given MAC.
+func (p *captivePortal) Revoke(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	mac = hw.String()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+
+	if _, approved := p.state.Approvals[mac]; !approved {
+		return nil
+	}
+	delete(p.state.Approvals, mac)
+	if err := p.disallow(mac); err != nil {
+		return err
+	}
+	return p.state.save()
+}
+
+// ClientByIP returns the MAC of the device with the given IP, and whether
+// it has been approved. Unapproved devices are recorded as pending.
+func (p *captivePortal) ClientByIP(ip net.IP) (string, bool, error) {
+	hw, err := HardwareAddrByIP(p.bridge, ip)
+	if err != nil {
+		return "", false, err
+	}
+	mac := hw.String()
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+
+	if exp, approved := p.state.Approvals[mac]; approved && time.Now().Before(exp) {
+		return mac, true, nil
+	}
+	if _, seen := p.pending[mac]; !seen {
+		p.pending[mac] = time.Now()
+	}
+	return mac, false, nil
+}
+
+// Clients returns all pending and approved devices.
+func (p *captivePortal) Clients() []CaptiveClient {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+
+	var out []CaptiveClient
+	for mac, seen := range p.pending {
+		out = append(out, CaptiveClient{MAC: mac, FirstSeen: seen})
+	}
+	for mac, exp := range p.state.Approvals {
+		out = append(out, CaptiveClient{MAC: mac, Approved: true, Expires: exp})
+	}
+	sort.Slice(out, func(i, j int) bool { return strings.Compare(out[i].MAC, out[j].MAC) < 0 })
+	return out
+}
+
+// expire removes approvals which have expired.
+func (p *captivePortal) expire() error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.state.lock.Lock()
+	defer p.state.lock.Unlock()
+
+	changed := false
+	for mac, exp := range p.state.Approvals {
+		if time.Now().Before(exp) {
+			continue
+		}
+		if err := p.disallow(mac); err != nil {
+			return err
+		}
+		delete(p.state.Approvals, mac)
+		changed = true
+	}
+	if changed {
+		return p.state.save()
+	}
+	return nil
+}
+
+// Close removes all captive portal firewall rules.
+func (p *captivePortal) Close() error {
+	if err := p.ipt.Delete("filter", "FORWARD", "-i", p.bridge.Name, "-j", captiveChain); err != nil {
+		return err
+	}
+	if err := p.ipt.Delete("nat", "PREROUTING", "-i", p.bridge.Name, "-j", captiveChain); err != nil {
+		return err
+	}
+	for _, table := range []string{"filter", "nat"} {
+		if err := p.ipt.ClearChain(table, captiveChain); err != nil {
+			return err
+		}
+		if err := p.ipt.DeleteChain(table, captiveChain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *Controller) captiveRoutine() {
+	defer c.wg.Done()
+	t := time.NewTicker(30 * time.Second)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case <-t.C:
+			if err := c.captive.expire(); err != nil {
+				fmt.Printf("Failed to expire captive portal approvals: %v\n", err)
+			}
+		}
+	}
+}
+
+// CaptiveEnabled returns true if clients must be approved before they can use the network.
+func (c *Controller) CaptiveEnabled() bool {
+	return c.captive != nil
+}
+
+// CaptiveClientByIP returns the MAC address of the client with the given IP,
+// and whether it has been approved by the captive portal. Hosts outside the
+// bridge subnet are always considered approved.
+func (c *Controller) CaptiveClientByIP(ip net.IP) (string, bool, error) {
+	if c.captive == nil || !c.subnet.Contains(ip) || ip.Equal(c.bridgeAddr) {
+		return "", true, nil
+	}
+	return c.captive.ClientByIP(ip)
+}
+
+// CaptiveClients returns the devices known to the captive portal.
+func (c *Controller) CaptiveClients() []CaptiveClient {
+	if c.captive == nil {
+		return nil
+	}
+	return c.captive.Clients()
+}
+
+// CaptiveApprove allows the device with the given MAC to use the network.
+func (c *Controller) CaptiveApprove(mac string) error {
+	if c.captive == nil {
+		return errCaptiveDisabled
+	}
+	return c.captive.Approve(mac)
+}
+
+// CaptiveRevoke firewalls the device with the given MAC back to the portal.
+func (c *Controller) CaptiveRevoke(mac string) error {
+	if c.captive == nil {
+		return errCaptiveDisabled
+	}
+	return c.captive.Revoke(mac)
+}
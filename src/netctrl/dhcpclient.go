@@ -0,0 +1,190 @@
+package netctrl
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+
+	"github.com/krolaw/dhcp4"
+)
+
+const (
+	dhcpAttempts     = 4
+	dhcpReplyTimeout = 3 * time.Second
+)
+
+var (
+	errDHCPNak     = errors.New("DHCP server refused the lease")
+	errDHCPStopped = errors.New("DHCP client stopped")
+)
+
+// dhcpLease is an address leased from an upstream DHCP server.
+type dhcpLease struct {
+	Addr     *net.IPNet
+	Gateway  net.IP
+	Server   net.IP
+	Obtained time.Time
+	Duration time.Duration
+}
+
+// dhcpClient obtains leases for an interface, such as the uplink.
+type dhcpClient struct {
+	iface *net.Interface
+	conn  net.PacketConn
+	// stop abandons exchanges in progress once closed.
+	stop <-chan struct{}
+}
+
+func newDHCPClient(iface *net.Interface, stop <-chan struct{}) (*dhcpClient, error) {
+	bind := BindToDevice(iface.Name)
+	lc := net.ListenConfig{Control: func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_BROADCAST, 1)
+		})
+		if err != nil {
+			return err
+		}
+		if opErr != nil {
+			return opErr
+		}
+		return bind(network, address, c)
+	}}
+	conn, err := lc.ListenPacket(context.Background(), "udp4", ":68")
+	if err != nil {
+		return nil, err
+	}
+	return &dhcpClient{iface: iface, conn: conn, stop: stop}, nil
+}
+
+// Close releases the socket.
+func (d *dhcpClient) Close() error {
+	return d.conn.Close()
+}
+
+func (d *dhcpClient) options(extra ...dhcp4.Option) []dhcp4.Option {
+	return append([]dhcp4.Option{{
+		Code:  dhcp4.OptionParameterRequestList,
+		Value: []byte{byte(dhcp4.OptionSubnetMask), byte(dhcp4.OptionRouter), byte(dhcp4.OptionIPAddressLeaseTime)},
+	}}, extra...)
+}
+
+// acquire obtains a new lease, broadcasting to find a server.
+func (d *dhcpClient) acquire() (*dhcpLease, error) {
+	xid := dhcpXID()
+	broadcast := &net.UDPAddr{IP: net.IPv4bcast, Port: 67}
+	offer, err := d.exchange(dhcp4.RequestPacket(dhcp4.Discover, d.iface.HardwareAddr, nil, xid, true, d.options()), broadcast, xid, dhcp4.Offer)
+	if err != nil {
+		return nil, err
+	}
+	serverID := offer.ParseOptions()[dhcp4.OptionServerIdentifier]
+	req := dhcp4.RequestPacket(dhcp4.Request, d.iface.HardwareAddr, nil, xid, true, d.options(
+		dhcp4.Option{Code: dhcp4.OptionRequestedIPAddress, Value: []byte(offer.YIAddr().To4())},
+		dhcp4.Option{Code: dhcp4.OptionServerIdentifier, Value: serverID},
+	))
+	ack, err := d.exchange(req, broadcast, xid, dhcp4.ACK)
+	if err != nil {
+		return nil, err
+	}
+	return parseDHCPLease(ack)
+}
+
+// renew extends a lease, asking the server which granted it.
+func (d *dhcpClient) renew(l *dhcpLease) (*dhcpLease, error) {
+	xid := dhcpXID()
+	req := dhcp4.RequestPacket(dhcp4.Request, d.iface.HardwareAddr, l.Addr.IP, xid, false, d.options())
+	ack, err := d.exchange(req, &net.UDPAddr{IP: l.Server, Port: 67}, xid, dhcp4.ACK)
+	if err != nil {
+		return nil, err
+	}
+	return parseDHCPLease(ack)
+}
+
+// release gives a lease back to the server.
+func (d *dhcpClient) release(l *dhcpLease) error {
+	req := dhcp4.RequestPacket(dhcp4.Release, d.iface.HardwareAddr, l.Addr.IP, dhcpXID(), false, []dhcp4.Option{
+		{Code: dhcp4.OptionServerIdentifier, Value: []byte(l.Server.To4())},
+	})
+	_, err := d.conn.WriteTo(req, &net.UDPAddr{IP: l.Server, Port: 67})
+	return err
+}
+
+// exchange sends req until a reply of the wanted type arrives.
+func (d *dhcpClient) exchange(req dhcp4.Packet, to net.Addr, xid []byte, want dhcp4.MessageType) (dhcp4.Packet, error) {
+	buf := make([]byte, 1500)
+	for attempt := 0; attempt < dhcpAttempts; attempt++ {
+		select {
+		case <-d.stop:
+			return nil, errDHCPStopped
+		default:
+		}
+		if _, err := d.conn.WriteTo(req, to); err != nil {
+			return nil, err
+		}
+		deadline := time.Now().Add(dhcpReplyTimeout)
+		if err := d.conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		for {
+			n, _, err := d.conn.ReadFrom(buf)
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			p := dhcp4.Packet(append([]byte(nil), buf[:n]...))
+			if n < 240 || p.OpCode() != dhcp4.BootReply || string(p.XId()) != string(xid) {
+				continue
+			}
+			t := p.ParseOptions()[dhcp4.OptionDHCPMessageType]
+			if len(t) != 1 {
+				continue
+			}
+			switch dhcp4.MessageType(t[0]) {
+			case want:
+				return p, nil
+			case dhcp4.NAK:
+				return nil, errDHCPNak
+			}
+		}
+	}
+	return nil, fmt.Errorf("no DHCP %v received on %s", want, d.iface.Name)
+}
+
+func parseDHCPLease(p dhcp4.Packet) (*dhcpLease, error) {
+	opts := p.ParseOptions()
+	mask := opts[dhcp4.OptionSubnetMask]
+	if len(mask) != 4 {
+		return nil, errors.New("DHCP lease has no subnet mask")
+	}
+	server := opts[dhcp4.OptionServerIdentifier]
+	if len(server) != 4 {
+		return nil, errors.New("DHCP lease has no server identifier")
+	}
+	leaseTime := opts[dhcp4.OptionIPAddressLeaseTime]
+	if len(leaseTime) != 4 {
+		return nil, errors.New("DHCP lease has no lease time")
+	}
+	l := &dhcpLease{
+		Addr:     &net.IPNet{IP: append(net.IP(nil), p.YIAddr()...), Mask: net.IPMask(mask)},
+		Server:   net.IP(server),
+		Obtained: time.Now(),
+		Duration: time.Duration(binary.BigEndian.Uint32(leaseTime)) * time.Second,
+	}
+	if router := opts[dhcp4.OptionRouter]; len(router) >= 4 {
+		l.Gateway = net.IP(router[:4])
+	}
+	return l, nil
+}
+
+func dhcpXID() []byte {
+	xid := make([]byte, 4)
+	rand.Read(xid)
+	return xid
+}
@@ -3,7 +3,7 @@ package netctrl
 import "net"
 
 type dhcpLimitedBroadcastListener struct {
-	conn      *net.UDPConn
+	conn      net.PacketConn
 	bcastAddr net.IP
 }
 
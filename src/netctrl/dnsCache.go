@@ -0,0 +1,218 @@
+package netctrl
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// cacheMaxTTL caps how long any response is cached for.
+	cacheMaxTTL = 24 * time.Hour
+	// prefetchMinHits is the number of hits an entry must have had before
+	// it is refreshed ahead of expiry.
+	prefetchMinHits = 3
+)
+
+// DNSCacheStats describes the performance of the DNS cache.
+type DNSCacheStats struct {
+	Entries    int    `json:"entries"`
+	Capacity   int    `json:"capacity"`
+	Hits       uint64 `json:"hits"`
+	Misses     uint64 `json:"misses"`
+	Prefetches uint64 `json:"prefetches"`
+	Evictions  uint64 `json:"evictions"`
+	Flushes    uint64 `json:"flushes"`
+}
+
+type cacheKey struct {
+	name   string
+	qtype  uint16
+	qclass uint16
+	dnssec bool
+	cd     bool
+}
+
+type cacheEntry struct {
+	key         cacheKey
+	msg         *dns.Msg
+	stored      time.Time
+	ttl         time.Duration
+	hits        int
+	prefetching bool
+}
+
+// dnsCache is a bounded, least-recently-used cache of DNS responses, which
+// honours record TTLs and the SOA minimum of negative responses.
+type dnsCache struct {
+	lock       sync.Mutex
+	maxEntries int
+	entries    map[cacheKey]*list.Element
+	lru        *list.List
+	stats      DNSCacheStats
+}
+
+func newDNSCache(maxEntries int) *dnsCache {
+	return &dnsCache{
+		maxEntries: maxEntries,
+		entries:    map[cacheKey]*list.Element{},
+		lru:        list.New(),
+	}
+}
+
+func cacheKeyFor(r *dns.Msg) cacheKey {
+	q := r.Question[0]
+	k := cacheKey{name: strings.ToLower(q.Name), qtype: q.Qtype, qclass: q.Qclass, cd: r.CheckingDisabled}
+	if opt := r.IsEdns0(); opt != nil {
+		k.dnssec = opt.Do()
+	}
+	return k
+}
+
+// cacheTTL returns how long the response may be cached for, or zero if it
+// should not be cached.
+func cacheTTL(m *dns.Msg) time.Duration {
+	if m.Truncated {
+		return 0
+	}
+
+	switch {
+	case m.Rcode == dns.RcodeNameError, m.Rcode == dns.RcodeSuccess && len(m.Answer) == 0:
+		// RFC 2308: negative responses are cached for the lesser of the
+		// SOA TTL and the SOA minimum field.
+		for _, rr := range m.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				ttl := soa.Hdr.Ttl
+				if soa.Minttl < ttl {
+					ttl = soa.Minttl
+				}
+				return capTTL(ttl)
+			}
+		}
+		return 0
+	case m.Rcode == dns.RcodeSuccess:
+		min := uint32(0)
+		first := true
+		for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+			for _, rr := range section {
+				if rr.Header().Rrtype == dns.TypeOPT {
+					continue
+				}
+				if first || rr.Header().Ttl < min {
+					min = rr.Header().Ttl
+					first = false
+				}
+			}
+		}
+		return capTTL(min)
+	}
+	return 0
+}
+
+func capTTL(ttl uint32) time.Duration {
+	d := time.Duration(ttl) * time.Second
+	if d > cacheMaxTTL {
+		return cacheMaxTTL
+	}
+	return d
+}
+
+// Get returns a cached response to the query, with TTLs adjusted for the
+// time spent in the cache. prefetch is true if the caller should refresh
+// the entry, as it is popular and close to expiry.
+func (c *dnsCache) Get(r *dns.Msg) (m *dns.Msg, prefetch bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	k := cacheKeyFor(r)
+	elem, ok := c.entries[k]
+	if !ok {
+		c.stats.Misses++
+		return nil, false
+	}
+	e := elem.Value.(*cacheEntry)
+	age := time.Since(e.stored)
+	if age >= e.ttl {
+		c.remove(elem)
+		c.stats.Misses++
+		return nil, false
+	}
+
+	c.lru.MoveToFront(elem)
+	c.stats.Hits++
+	e.hits++
+	if e.hits >= prefetchMinHits && !e.prefetching && e.ttl-age <= e.ttl/10 {
+		e.prefetching = true
+		prefetch = true
+		c.stats.Prefetches++
+	}
+
+	m = e.msg.Copy()
+	m.Id = r.Id
+	elapsed := uint32(age / time.Second)
+	for _, section := range [][]dns.RR{m.Answer, m.Ns, m.Extra} {
+		for _, rr := range section {
+			if h := rr.Header(); h.Rrtype != dns.TypeOPT {
+				if h.Ttl > elapsed {
+					h.Ttl -= elapsed
+				} else {
+					h.Ttl = 0
+				}
+			}
+		}
+	}
+	return m, prefetch
+}
+
+// Put stores the response to the query, if it can be cached.
+func (c *dnsCache) Put(r, m *dns.Msg) {
+	ttl := cacheTTL(m)
+	if ttl <= 0 {
+		return
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	k := cacheKeyFor(r)
+	e := &cacheEntry{key: k, msg: m.Copy(), stored: time.Now(), ttl: ttl}
+	if elem, ok := c.entries[k]; ok {
+		// Keep popularity across refreshes, so prefetching continues.
+		e.hits = elem.Value.(*cacheEntry).hits
+		c.remove(elem)
+	}
+	c.entries[k] = c.lru.PushFront(e)
+
+	for c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.stats.Evictions++
+	}
+}
+
+// remove deletes an entry. The caller must hold c.lock.
+func (c *dnsCache) remove(elem *list.Element) {
+	delete(c.entries, elem.Value.(*cacheEntry).key)
+	c.lru.Remove(elem)
+}
+
+// Flush removes all entries from the cache.
+func (c *dnsCache) Flush() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.entries = map[cacheKey]*list.Element{}
+	c.lru.Init()
+	c.stats.Flushes++
+}
+
+// Stats returns statistics about the cache.
+func (c *dnsCache) Stats() DNSCacheStats {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	out := c.stats
+	out.Entries = c.lru.Len()
+	out.Capacity = c.maxEntries
+	return out
+}
@@ -0,0 +1,349 @@
+package netctrl
+
+import (
+	"bufio"
+	"config"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// DNSFilterStatus describes a loaded blocklist or allowlist.
+type DNSFilterStatus struct {
+	Name      string    `json:"name"`
+	Source    string    `json:"source"`
+	Allowlist bool      `json:"allowlist"`
+	Rules     int       `json:"rules"`
+	Hits      uint64    `json:"hits"`
+	Loaded    time.Time `json:"loaded"`
+	LoadError string    `json:"load_error,omitempty"`
+}
+
+// filterRules is a set of domain matching rules.
+type filterRules struct {
+	exact   map[string]bool // matches only the name itself
+	suffix  map[string]bool // matches the name and all its subdomains
+	regexps []*regexp.Regexp
+}
+
+func newFilterRules() *filterRules {
+	return &filterRules{exact: map[string]bool{}, suffix: map[string]bool{}}
+}
+
+func (r *filterRules) count() int {
+	return len(r.exact) + len(r.suffix) + len(r.regexps)
+}
+
+// add parses a single rule. Supported forms are plain domains,
+// *.wildcards, ||adblock^ rules and /regular expressions/.
+func (r *filterRules) add(rule string) error {
+	switch {
+	case len(rule) > 2 && strings.HasPrefix(rule, "/") && strings.HasSuffix(rule, "/"):
+		re, err := regexp.Compile(rule[1 : len(rule)-1])
+		if err != nil {
+			return err
+		}
+		r.regexps = append(r.regexps, re)
+	case strings.HasPrefix(rule, "||"):
+		rule = strings.TrimPrefix(rule, "||")
+		rule = strings.TrimSuffix(rule, "^")
+		if strings.ContainsAny(rule, "/*$^") {
+			return fmt.Errorf("unsupported adblock rule %q", rule)
+		}
+		r.suffix[strings.ToLower(rule)] = true
+	case strings.HasPrefix(rule, "*."):
+		r.suffix[strings.ToLower(rule[2:])] = true
+	case strings.Contains(rule, "*"):
+		re, err := regexp.Compile("^" + strings.Replace(regexp.QuoteMeta(strings.ToLower(rule)), `\*`, ".*", -1) + "$")
+		if err != nil {
+			return err
+		}
+		r.regexps = append(r.regexps, re)
+	default:
+		r.exact[strings.ToLower(rule)] = true
+	}
+	return nil
+}
+
+// matches returns true if name (lowercase, without a trailing dot) matches
+// any rule.
+func (r *filterRules) matches(name string) bool {
+	if r.exact[name] {
+		return true
+	}
+	for n := name; n != ""; {
+		if r.suffix[n] {
+			return true
+		}
+		i := strings.Index(n, ".")
+		if i < 0 {
+			break
+		}
+		n = n[i+1:]
+	}
+	for _, re := range r.regexps {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// filterList is a named set of rules and its hit counter.
+type filterList struct {
+	status DNSFilterStatus
+	rules  *filterRules
+	hits   uint64
+}
+
+// parseFilterList reads a list in hosts or adblock format. Adblock
+// exception rules (@@) are returned separately as allow rules.
+func parseFilterList(r io.Reader) (block, allow *filterRules, err error) {
+	block, allow = newFilterRules(), newFilterRules()
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		// Cosmetic rules hide page elements, and say nothing about DNS.
+		if strings.Contains(line, "##") || strings.Contains(line, "#@#") || strings.Contains(line, "#?#") {
+			continue
+		}
+		line = stripComment(line)
+		if line == "" || strings.HasPrefix(line, "!") || strings.HasPrefix(line, "[") {
+			continue
+		}
+
+		if strings.HasPrefix(line, "@@") {
+			if err := allow.add(line[2:]); err != nil {
+				fmt.Printf("Skipping filter rule %q: %v\n", line, err)
+			}
+			continue
+		}
+
+		// hosts format: <address> <name> [<name>...]
+		if f := strings.Fields(line); len(f) > 1 && net.ParseIP(f[0]) != nil {
+			for _, name := range f[1:] {
+				if name != "localhost" && name != "localhost.localdomain" && name != "0.0.0.0" {
+					block.exact[strings.ToLower(name)] = true
+				}
+			}
+			continue
+		}
+		if err := block.add(line); err != nil {
+			fmt.Printf("Skipping filter rule %q: %v\n", line, err)
+		}
+	}
+	return block, allow, s.Err()
+}
+
+// stripComment removes a # comment, which starts the line or follows
+// whitespace.
+func stripComment(line string) string {
+	for i, r := range line {
+		if r == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t') {
+			return strings.TrimSpace(line[:i])
+		}
+	}
+	return line
+}
+
+func openFilterSource(source string) (io.ReadCloser, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		return os.Open(source)
+	}
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Get(source)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %s: status %d", source, resp.StatusCode)
+	}
+	return resp.Body, nil
+}
+
+// dnsFilter blocks queries for names on the configured blocklists, unless
+// they also appear on an allowlist.
+type dnsFilter struct {
+	conf *config.Config
+
+	lock       sync.RWMutex
+	blocklists []*filterList
+	allowlist  *filterList
+}
+
+func newDNSFilter(conf *config.Config) *dnsFilter {
+	return &dnsFilter{conf: conf}
+}
+
+// Reload (re)reads all lists. Lists which fail to load keep their
+// previous rules.
+func (f *dnsFilter) Reload() {
+	allow := newFilterRules()
+	for _, rule := range f.conf.DNS.Allowlist {
+		if err := allow.add(rule); err != nil {
+			fmt.Printf("Skipping allowlist rule %q: %v\n", rule, err)
+		}
+	}
+
+	f.lock.RLock()
+	previous := map[string]*filterList{}
+	for _, l := range f.blocklists {
+		previous[l.status.Name] = l
+	}
+	f.lock.RUnlock()
+
+	var lists []*filterList
+	for _, conf := range f.conf.DNS.Blocklists {
+		l := &filterList{status: DNSFilterStatus{Name: conf.Name, Source: conf.Source}}
+		if prev, ok := previous[conf.Name]; ok {
+			l.rules, l.hits = prev.rules, atomic.LoadUint64(&prev.hits)
+			l.status.Loaded = prev.status.Loaded
+		}
+
+		block, listAllow, err := f.load(conf.Source)
+		if err != nil {
+			fmt.Printf("Failed to load DNS blocklist %q: %v\n", conf.Name, err)
+			l.status.LoadError = err.Error()
+		} else {
+			l.rules = block
+			l.status.Loaded = time.Now()
+			for n := range listAllow.exact {
+				allow.exact[n] = true
+			}
+			for n := range listAllow.suffix {
+				allow.suffix[n] = true
+			}
+			allow.regexps = append(allow.regexps, listAllow.regexps...)
+		}
+		if l.rules == nil {
+			l.rules = newFilterRules()
+		}
+		l.status.Rules = l.rules.count()
+		lists = append(lists, l)
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	allowList := &filterList{
+		status: DNSFilterStatus{Name: "allowlist", Allowlist: true, Rules: allow.count(), Loaded: time.Now()},
+		rules:  allow,
+	}
+	if f.allowlist != nil {
+		allowList.hits = atomic.LoadUint64(&f.allowlist.hits)
+	}
+	f.blocklists, f.allowlist = lists, allowList
+}
+
+func (f *dnsFilter) load(source string) (block, allow *filterRules, err error) {
+	r, err := openFilterSource(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer r.Close()
+	return parseFilterList(r)
+}
+
+// Blocked returns true if queries for name should be blocked.
+func (f *dnsFilter) Blocked(name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.allowlist != nil && f.allowlist.rules.matches(name) {
+		atomic.AddUint64(&f.allowlist.hits, 1)
+		return false
+	}
+	for _, l := range f.blocklists {
+		if l.rules.matches(name) {
+			atomic.AddUint64(&l.hits, 1)
+			return true
+		}
+	}
+	return false
+}
+
+// Status returns information about each loaded list.
+func (f *dnsFilter) Status() []DNSFilterStatus {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var out []DNSFilterStatus
+	for _, l := range f.blocklists {
+		s := l.status
+		s.Hits = atomic.LoadUint64(&l.hits)
+		out = append(out, s)
+	}
+	if f.allowlist != nil {
+		s := f.allowlist.status
+		s.Hits = atomic.LoadUint64(&f.allowlist.hits)
+		out = append(out, s)
+	}
+	return out
+}
+
+// blockedResponse returns the configured answer for a blocked query.
+func blockedResponse(r *dns.Msg, mode string, portalIP net.IP) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.RecursionAvailable = true
+
+	q := r.Question[0]
+	hdr := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 60}
+	switch mode {
+	case "zero":
+		switch q.Qtype {
+		case dns.TypeA:
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.IPv4zero})
+		case dns.TypeAAAA:
+			m.Answer = append(m.Answer, &dns.AAAA{Hdr: hdr, AAAA: net.IPv6zero})
+		}
+	case "portal":
+		if q.Qtype == dns.TypeA {
+			m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: portalIP})
+		}
+	default:
+		m.Rcode = dns.RcodeNameError
+	}
+	return m
+}
+
+func (c *Controller) dnsFilterRoutine() {
+	defer c.wg.Done()
+	c.dnsFilter.Reload()
+
+	interval, _ := time.ParseDuration(c.config.DNS.BlocklistRefresh)
+	if interval <= 0 {
+		return
+	}
+	t := time.NewTicker(interval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case <-t.C:
+			c.dnsFilter.Reload()
+		}
+	}
+}
+
+// ReloadDNSFilters re-reads the DNS blocklists and allowlists.
+func (c *Controller) ReloadDNSFilters() {
+	c.dnsFilter.Reload()
+}
+
+// DNSFilterStatus returns information about each DNS blocklist.
+func (c *Controller) DNSFilterStatus() []DNSFilterStatus {
+	return c.dnsFilter.Status()
+}
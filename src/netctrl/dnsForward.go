@@ -0,0 +1,112 @@
+package netctrl
+
+import (
+	"config"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+)
+
+// forwardRule sends queries for a domain to a specific upstream.
+type forwardRule struct {
+	domain string
+	pool   *upstreamPool
+	// uplink is true if queries are sent over the uplink, so can be made
+	// while the VPN is down.
+	uplink bool
+}
+
+// newForwardRules creates the rules for the given forwards. Queries are
+// sent through tunnelDevice unless a forward specifies the uplink.
+func newForwardRules(forwards []config.DNSForward, tunnelDevice string) ([]*forwardRule, error) {
+	var out []*forwardRule
+	for _, f := range forwards {
+		bindDevice := tunnelDevice
+		if f.Uplink {
+			bindDevice = ""
+		}
+		pool, err := newUpstreamPool([]config.DNSUpstream{f.DNSUpstream}, bindDevice)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range f.Domains {
+			domain := dns.Fqdn(strings.ToLower(strings.TrimPrefix(d, "*.")))
+			out = append(out, &forwardRule{domain: domain, pool: pool, uplink: f.Uplink})
+		}
+	}
+	return out, nil
+}
+
+// dnsForwarder holds conditional forwarding rules: those which are always
+// active, and those belonging to the active VPN.
+type dnsForwarder struct {
+	lock   sync.RWMutex
+	global []*forwardRule
+	vpn    []*forwardRule
+}
+
+// Match returns the rule for the most specific domain containing name,
+// or nil if queries for name go to the default upstreams. Any rule for the
+// active VPN which matches takes precedence over the global rules.
+func (f *dnsForwarder) Match(name string) *forwardRule {
+	name = strings.ToLower(name)
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	if best := matchForwardRule(f.vpn, name); best != nil {
+		return best
+	}
+	return matchForwardRule(f.global, name)
+}
+
+// matchForwardRule returns the rule for the most specific domain containing
+// name, or nil if none do.
+func matchForwardRule(rules []*forwardRule, name string) *forwardRule {
+	var best *forwardRule
+	for _, r := range rules {
+		if dns.IsSubDomain(r.domain, name) && (best == nil || dns.CountLabel(r.domain) > dns.CountLabel(best.domain)) {
+			best = r
+		}
+	}
+	return best
+}
+
+// SetVPNRules replaces the rules for the active VPN.
+func (f *dnsForwarder) SetVPNRules(rules []*forwardRule) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, r := range f.vpn {
+		r.pool.CloseIdleConnections()
+	}
+	f.vpn = rules
+}
+
+// CloseIdleConnections closes connections kept open to upstreams.
+func (f *dnsForwarder) CloseIdleConnections() {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	for _, rules := range [][]*forwardRule{f.vpn, f.global} {
+		for _, r := range rules {
+			r.pool.CloseIdleConnections()
+		}
+	}
+}
+
+// Status returns the health of each forwarding upstream.
+func (f *dnsForwarder) Status() []UpstreamStatus {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+
+	var out []UpstreamStatus
+	seen := map[*upstreamPool]bool{}
+	for _, rules := range [][]*forwardRule{f.vpn, f.global} {
+		for _, r := range rules {
+			if !seen[r.pool] {
+				seen[r.pool] = true
+				out = append(out, r.pool.Status()...)
+			}
+		}
+	}
+	return out
+}
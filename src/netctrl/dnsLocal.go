@@ -0,0 +1,201 @@
+package netctrl
+
+import (
+	"config"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	localTTL      = 60
+	maxCNAMEChain = 8
+)
+
+// localZone is a zone rnd is authoritative for.
+type localZone struct {
+	origin  string
+	soa     *dns.SOA
+	ns      *dns.NS
+	records map[string][]dns.RR
+}
+
+func newLocalZone(origin, routerName string) *localZone {
+	hdr := func(t uint16) dns.RR_Header {
+		return dns.RR_Header{Name: origin, Rrtype: t, Class: dns.ClassINET, Ttl: localTTL}
+	}
+	return &localZone{
+		origin: origin,
+		soa: &dns.SOA{
+			Hdr:     hdr(dns.TypeSOA),
+			Ns:      routerName,
+			Mbox:    "hostmaster." + routerName,
+			Serial:  1,
+			Refresh: 3600,
+			Retry:   600,
+			Expire:  86400,
+			Minttl:  localTTL,
+		},
+		ns:      &dns.NS{Hdr: hdr(dns.TypeNS), Ns: routerName},
+		records: map[string][]dns.RR{},
+	}
+}
+
+// localRecords answers queries for names configured locally, which take
+// precedence over upstream answers.
+type localRecords struct {
+	zones []*localZone
+	// records holds names which are overridden individually, outside of
+	// any local zone.
+	records map[string][]dns.RR
+}
+
+// routerDomain returns the name the router is reachable at.
+func routerDomain(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '-', r == '.':
+			b.WriteRune(r)
+		default:
+			b.WriteRune('-')
+		}
+	}
+	if d := strings.Trim(b.String(), "-."); d != "" {
+		return dns.Fqdn(d)
+	}
+	return "rnd."
+}
+
+func newLocalRecords(c *config.Config, routerIP net.IP) (*localRecords, error) {
+	routerName := routerDomain(c.Name)
+	l := &localRecords{records: map[string][]dns.RR{}}
+
+	router := newLocalZone(routerName, routerName)
+	router.records[routerName] = []dns.RR{&dns.A{
+		Hdr: dns.RR_Header{Name: routerName, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: localTTL},
+		A:   routerIP,
+	}}
+	l.zones = append(l.zones, router)
+	for _, z := range c.DNS.LocalZones {
+		l.zones = append(l.zones, newLocalZone(dns.Fqdn(strings.ToLower(z)), routerName))
+	}
+	// Match the most specific zone first.
+	sort.Slice(l.zones, func(i, j int) bool {
+		return dns.CountLabel(l.zones[i].origin) > dns.CountLabel(l.zones[j].origin)
+	})
+
+	l.add(&dns.A{
+		Hdr: dns.RR_Header{Name: "googledns.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 0},
+		A:   net.ParseIP("8.8.8.8"),
+	})
+	for _, rec := range c.DNS.Records {
+		ttl := uint32(rec.TTL)
+		if ttl == 0 {
+			ttl = localTTL
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s %d IN %s %s", dns.Fqdn(rec.Name), ttl, strings.ToUpper(rec.Type), rec.Value))
+		if err != nil {
+			return nil, fmt.Errorf("dns record %q: %v", rec.Name, err)
+		}
+		if rr == nil {
+			return nil, fmt.Errorf("dns record %q: no value", rec.Name)
+		}
+		l.add(rr)
+	}
+	return l, nil
+}
+
+func (l *localRecords) add(rr dns.RR) {
+	name := strings.ToLower(rr.Header().Name)
+	if z := l.zoneFor(name); z != nil {
+		z.records[name] = append(z.records[name], rr)
+		return
+	}
+	l.records[name] = append(l.records[name], rr)
+}
+
+func (l *localRecords) zoneFor(name string) *localZone {
+	for _, z := range l.zones {
+		if dns.IsSubDomain(z.origin, name) {
+			return z
+		}
+	}
+	return nil
+}
+
+// Answer returns a response if the query is for a local name, otherwise nil.
+func (l *localRecords) Answer(r *dns.Msg) *dns.Msg {
+	return l.answer(r, 0)
+}
+
+func (l *localRecords) answer(r *dns.Msg, depth int) *dns.Msg {
+	q := r.Question[0]
+	name := strings.ToLower(q.Name)
+
+	z := l.zoneFor(name)
+	rrs, exists := l.records[name]
+	if z == nil && !exists {
+		return nil
+	}
+	if z != nil {
+		rrs, exists = z.records[name]
+		if name == z.origin {
+			rrs = append([]dns.RR{z.soa, z.ns}, rrs...)
+			exists = true
+		}
+	}
+
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Authoritative = z != nil
+	m.RecursionAvailable = true
+	m.Answer = matchingRecords(rrs, q)
+	if len(m.Answer) > 0 {
+		// Follow a CNAME if its target is also local.
+		if cname, ok := m.Answer[0].(*dns.CNAME); ok && q.Qtype != dns.TypeCNAME && depth < maxCNAMEChain {
+			target := r.Copy()
+			target.Question[0].Name = cname.Target
+			if resp := l.answer(target, depth+1); resp != nil {
+				m.Answer = append(m.Answer, resp.Answer...)
+			}
+		}
+		return m
+	}
+
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	if z != nil {
+		m.Ns = []dns.RR{z.soa}
+	}
+	return m
+}
+
+// matchingRecords returns the records answering the question, or the CNAME
+// at that name if there is one.
+func matchingRecords(rrs []dns.RR, q dns.Question) []dns.RR {
+	var out []dns.RR
+	for _, rr := range rrs {
+		t := rr.Header().Rrtype
+		if t == q.Qtype || q.Qtype == dns.TypeANY {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			out = append(out, rr)
+		}
+	}
+	if len(out) > 0 {
+		return out
+	}
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeCNAME {
+			rr = dns.Copy(rr)
+			rr.Header().Name = q.Name
+			return []dns.RR{rr}
+		}
+	}
+	return nil
+}
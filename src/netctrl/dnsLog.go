@@ -0,0 +1,275 @@
+package netctrl
+
+import (
+	"config"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var errQueryLogDisabled = errors.New("DNS query logging is not enabled")
+
+// Sources a DNS response can come from.
+const (
+	sourceLocal    = "local"
+	sourceCache    = "cache"
+	sourceUpstream = "upstream"
+	sourceBlocked  = "blocked"
+	sourceRebind   = "rebind"
+	sourceCaptive  = "captive"
+	sourceRefused  = "refused"
+	sourceError    = "error"
+)
+
+// QueryLogEntry records a single DNS query and its response.
+type QueryLogEntry struct {
+	Time      time.Time `json:"time"`
+	ClientIP  string    `json:"client_ip"`
+	ClientMAC string    `json:"client_mac,omitempty"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Rcode     string    `json:"rcode"`
+	Answers   []string  `json:"answers,omitempty"`
+	LatencyMS float64   `json:"latency_ms"`
+	Source    string    `json:"source"`
+}
+
+// DomainCount is the number of times a name was queried.
+type DomainCount struct {
+	Name  string `json:"name"`
+	Count int    `json:"count"`
+}
+
+// ClientQueryStats summarises the queries made by a client.
+type ClientQueryStats struct {
+	Queries    int           `json:"queries"`
+	Blocked    int           `json:"blocked"`
+	TopDomains []DomainCount `json:"top_domains"`
+}
+
+// queryLog keeps the most recent queries in memory, and optionally appends
+// them to a file which is rotated once it grows too large.
+type queryLog struct {
+	lock    sync.Mutex
+	entries []QueryLogEntry
+	next    int
+	full    bool
+
+	anonymize bool
+	salt      []byte
+
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func newQueryLog(c *config.Config) (*queryLog, error) {
+	conf := c.DNS.QueryLog
+	l := &queryLog{
+		entries:   make([]QueryLogEntry, conf.Size),
+		anonymize: conf.Anonymize,
+		path:      conf.File,
+		maxSize:   int64(conf.MaxFileSizeMB) * 1024 * 1024,
+	}
+	if l.anonymize {
+		l.salt = make([]byte, 16)
+		if _, err := rand.Read(l.salt); err != nil {
+			return nil, err
+		}
+	}
+	if l.path != "" {
+		if err := l.open(); err != nil {
+			return nil, err
+		}
+	}
+	return l, nil
+}
+
+func (l *queryLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, s.Size()
+	return nil
+}
+
+// rotate moves the current log file aside and starts a new one. The caller
+// must hold l.lock.
+func (l *queryLog) rotate() error {
+	l.file.Close()
+	l.file = nil
+	if err := os.Rename(l.path, l.path+".1"); err != nil {
+		return err
+	}
+	return l.open()
+}
+
+// pseudonym replaces a client identifier with a salted hash, so clients can
+// be told apart without recording who they are.
+func (l *queryLog) pseudonym(id string) string {
+	if id == "" {
+		return ""
+	}
+	h := sha256.Sum256(append(l.salt, id...))
+	return hex.EncodeToString(h[:6])
+}
+
+// Record logs the response to a query.
+func (l *queryLog) Record(clientIP, clientMAC string, r, m *dns.Msg, latency time.Duration, source string) {
+	e := QueryLogEntry{
+		Time:      time.Now(),
+		ClientIP:  clientIP,
+		ClientMAC: clientMAC,
+		Rcode:     dns.RcodeToString[m.Rcode],
+		LatencyMS: float64(latency) / float64(time.Millisecond),
+		Source:    source,
+	}
+	if len(r.Question) > 0 {
+		e.Name = r.Question[0].Name
+		e.Type = dns.TypeToString[r.Question[0].Qtype]
+	}
+	for _, rr := range m.Answer {
+		e.Answers = append(e.Answers, rr.String())
+	}
+	if l.anonymize {
+		e.ClientIP, e.ClientMAC = l.pseudonym(e.ClientIP), l.pseudonym(e.ClientMAC)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries[l.next] = e
+	l.next = (l.next + 1) % len(l.entries)
+	if l.next == 0 {
+		l.full = true
+	}
+
+	if l.file == nil {
+		return
+	}
+	d, _ := json.Marshal(e)
+	n, err := l.file.Write(append(d, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		fmt.Printf("Failed to write query log: %v\n", err)
+	}
+	if l.maxSize > 0 && l.size > l.maxSize {
+		if err := l.rotate(); err != nil {
+			fmt.Printf("Failed to rotate query log: %v\n", err)
+		}
+	}
+}
+
+// snapshot returns logged entries, oldest first. The caller must hold l.lock.
+func (l *queryLog) snapshot() []QueryLogEntry {
+	if !l.full {
+		return append([]QueryLogEntry(nil), l.entries[:l.next]...)
+	}
+	return append(append([]QueryLogEntry(nil), l.entries[l.next:]...), l.entries[:l.next]...)
+}
+
+// Recent returns up to limit of the most recent queries, newest first,
+// optionally only those from the given client.
+func (l *queryLog) Recent(client string, limit int) []QueryLogEntry {
+	l.lock.Lock()
+	all := l.snapshot()
+	l.lock.Unlock()
+
+	var out []QueryLogEntry
+	for i := len(all) - 1; i >= 0 && len(out) < limit; i-- {
+		if client == "" || all[i].ClientIP == client || all[i].ClientMAC == client {
+			out = append(out, all[i])
+		}
+	}
+	return out
+}
+
+// ClientStats summarises logged queries by client, listing up to top
+// domains for each.
+func (l *queryLog) ClientStats(top int) map[string]*ClientQueryStats {
+	l.lock.Lock()
+	all := l.snapshot()
+	l.lock.Unlock()
+
+	out := map[string]*ClientQueryStats{}
+	counts := map[string]map[string]int{}
+	for _, e := range all {
+		client := e.ClientMAC
+		if client == "" {
+			client = e.ClientIP
+		}
+		s, ok := out[client]
+		if !ok {
+			s = &ClientQueryStats{}
+			out[client] = s
+			counts[client] = map[string]int{}
+		}
+		s.Queries++
+		if e.Source == sourceBlocked {
+			s.Blocked++
+		}
+		counts[client][e.Name]++
+	}
+
+	for client, names := range counts {
+		var domains []DomainCount
+		for name, count := range names {
+			domains = append(domains, DomainCount{Name: name, Count: count})
+		}
+		sort.Slice(domains, func(i, j int) bool {
+			if domains[i].Count != domains[j].Count {
+				return domains[i].Count > domains[j].Count
+			}
+			return domains[i].Name < domains[j].Name
+		})
+		if len(domains) > top {
+			domains = domains[:top]
+		}
+		out[client].TopDomains = domains
+	}
+	return out
+}
+
+// Close closes the log file, if any.
+func (l *queryLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// RecentQueries returns the most recent DNS queries, newest first. If client
+// is not empty, only queries from that client IP or MAC are returned.
+func (c *Controller) RecentQueries(client string, limit int) ([]QueryLogEntry, error) {
+	if c.queryLog == nil {
+		return nil, errQueryLogDisabled
+	}
+	return c.queryLog.Recent(client, limit), nil
+}
+
+// QueryStats returns a summary of recent DNS queries for each client.
+func (c *Controller) QueryStats(top int) (map[string]*ClientQueryStats, error) {
+	if c.queryLog == nil {
+		return nil, errQueryLogDisabled
+	}
+	return c.queryLog.ClientStats(top), nil
+}
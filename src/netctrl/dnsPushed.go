@@ -0,0 +1,206 @@
+package netctrl
+
+import (
+	"bufio"
+	"config"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pushedOptionsEnv names the environment variable which tells the up
+// script where to record the options pushed by the VPN server.
+const pushedOptionsEnv = "RND_PUSHED_OPTIONS"
+
+// pushedOptionsScript records the options openvpn passes to up scripts as
+// foreign_option_<n> environment variables, then runs the up command from
+// the VPN's configuration, if there is one, as openvpn would have.
+func pushedOptionsScript(up string) string {
+	script := "#!/bin/sh\nenv | grep '^foreign_option_' > \"$" + pushedOptionsEnv + "\"\n"
+	if up != "" {
+		return script + "exec " + up + " \"$@\"\n"
+	}
+	return script + "exit 0\n"
+}
+
+// pushedOptionsHook is an openvpn up script which records pushed options.
+// openvpn runs it again each time it reconnects, so it must be kept until
+// openvpn exits.
+type pushedOptionsHook struct {
+	dir string
+	// read is when the options last read were recorded.
+	read time.Time
+}
+
+// newPushedOptionsHook creates the hook for vpn. It replaces any up script
+// in the VPN's configuration, so runs that script itself.
+func newPushedOptionsHook(vpn *config.VPNOpt) (*pushedOptionsHook, error) {
+	up, err := configuredUpCommand(vpn.Path)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir("", "rnd-vpn")
+	if err != nil {
+		return nil, err
+	}
+	h := &pushedOptionsHook{dir: dir}
+	if err := ioutil.WriteFile(h.script(), []byte(pushedOptionsScript(up)), 0700); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return h, nil
+}
+
+// configuredUpCommand returns the command given by the last up option in an
+// openvpn configuration file, or the empty string if there is none.
+func configuredUpCommand(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	var up string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if fields := strings.Fields(line); len(fields) > 1 && fields[0] == "up" {
+			up = strings.TrimSpace(line[len("up"):])
+		}
+	}
+	return up, s.Err()
+}
+
+func (h *pushedOptionsHook) script() string  { return filepath.Join(h.dir, "up.sh") }
+func (h *pushedOptionsHook) options() string { return filepath.Join(h.dir, "options") }
+
+// Args returns openvpn arguments which run the hook once the tunnel is up.
+// They must come after --config, to take precedence over any up script
+// the configuration sets, which the hook runs instead.
+func (h *pushedOptionsHook) Args() []string {
+	return []string{"--script-security", "2", "--setenv", pushedOptionsEnv, h.options(), "--up", h.script()}
+}
+
+// DNSServers returns the DNS servers pushed with dhcp-option DNS or DNS6.
+func (h *pushedOptionsHook) DNSServers() ([]net.IP, error) {
+	f, err := os.Open(h.options())
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if fi, err := f.Stat(); err == nil {
+		h.read = fi.ModTime()
+	}
+	return parsePushedDNS(f)
+}
+
+// Changed returns true if options have been recorded since they were last
+// read, such as after openvpn reconnected.
+func (h *pushedOptionsHook) Changed() bool {
+	fi, err := os.Stat(h.options())
+	return err == nil && !fi.ModTime().Equal(h.read)
+}
+
+// Close removes the hook's files.
+func (h *pushedOptionsHook) Close() error {
+	return os.RemoveAll(h.dir)
+}
+
+// parsePushedDNS extracts DNS servers from foreign_option_<n> variables,
+// such as "foreign_option_1=dhcp-option DNS 10.8.0.1".
+func parsePushedDNS(r io.Reader) ([]net.IP, error) {
+	var out []net.IP
+	s := bufio.NewScanner(r)
+	for s.Scan() {
+		i := strings.Index(s.Text(), "=")
+		if i < 0 {
+			continue
+		}
+		f := strings.Fields(s.Text()[i+1:])
+		if len(f) != 3 || f[0] != "dhcp-option" || (f[1] != "DNS" && f[1] != "DNS6") {
+			continue
+		}
+		if ip := net.ParseIP(f[2]); ip != nil {
+			out = append(out, ip)
+		}
+	}
+	return out, s.Err()
+}
+
+// newPushedUpstreamPool creates a pool forwarding to the DNS servers pushed
+// by the VPN, through the tunnel. If fallback is set, the default upstreams
+// are tried after them.
+func newPushedUpstreamPool(servers []net.IP, c *config.Config, fallback bool) (*upstreamPool, error) {
+	var confs []config.DNSUpstream
+	for _, ip := range servers {
+		confs = append(confs, config.DNSUpstream{
+			Name: fmt.Sprintf("vpn (%s)", ip),
+			URL:  net.JoinHostPort(ip.String(), "53"),
+		})
+	}
+	if fallback {
+		confs = append(confs, c.DNS.Upstreams...)
+	}
+	return newUpstreamPool(confs, "tun"+c.Network.InterfaceIdent)
+}
+
+// defaultDNSUpstreams returns the upstreams queries are forwarded to unless
+// a forwarding rule matches: those pushed by the active VPN if it is
+// configured to use them, otherwise the configured upstreams.
+func (c *Controller) defaultDNSUpstreams() *upstreamPool {
+	c.vpnDNSLock.RLock()
+	defer c.vpnDNSLock.RUnlock()
+	if c.vpnDNS != nil {
+		return c.vpnDNS
+	}
+	return c.dnsUpstreams
+}
+
+// setVPNDNS sets the upstreams pushed by the active VPN, or nil to revert
+// to the configured ones.
+func (c *Controller) setVPNDNS(p *upstreamPool) {
+	c.vpnDNSLock.Lock()
+	defer c.vpnDNSLock.Unlock()
+	if c.vpnDNS != nil {
+		c.vpnDNS.CloseIdleConnections()
+	}
+	c.vpnDNS = p
+}
+
+// usePushedDNS switches DNS to the servers pushed by the VPN.
+func (c *Controller) usePushedDNS(vpn *config.VPNOpt, hook *pushedOptionsHook) error {
+	servers, err := hook.DNSServers()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(servers) == 0 {
+		fmt.Printf("VPN %q did not push any DNS servers\n", vpn.Name)
+		if vpn.PushedDNSFallback {
+			return nil
+		}
+	}
+	p, err := newPushedUpstreamPool(servers, c.config, vpn.PushedDNSFallback)
+	if err != nil {
+		return err
+	}
+	c.setVPNDNS(p)
+	return nil
+}
+
+// refreshPushedDNS switches to the DNS servers pushed when the VPN last
+// reconnected, if they may have changed.
+func (c *Controller) refreshPushedDNS() {
+	c.setupLock.Lock()
+	defer c.setupLock.Unlock()
+	if c.vpnHook == nil || c.vpnInterface == nil || !c.vpnHook.Changed() {
+		return
+	}
+	if err := c.usePushedDNS(c.vpnConf, c.vpnHook); err != nil {
+		fmt.Printf("Failed to use DNS servers pushed by VPN %q: %v\n", c.vpnConf.Name, err)
+	}
+}
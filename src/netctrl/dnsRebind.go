@@ -0,0 +1,90 @@
+package netctrl
+
+import (
+	"config"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// sharedAddressSpace is the carrier-grade NAT range (RFC 6598), which is
+// not public either.
+var sharedAddressSpace = &net.IPNet{IP: net.IP{100, 64, 0, 0}, Mask: net.CIDRMask(10, 32)}
+
+// rebindProtection prevents DNS rebinding attacks, by removing upstream
+// answers which point at private, loopback or link-local addresses.
+type rebindProtection struct {
+	// refuse rejects the whole response, rather than stripping the
+	// offending records.
+	refuse bool
+	// allow matches names which are expected to have private addresses.
+	allow *filterRules
+}
+
+func newRebindProtection(c *config.Config) *rebindProtection {
+	p := &rebindProtection{refuse: c.DNS.RebindProtection.Action == "refuse", allow: newFilterRules()}
+	for _, rule := range c.DNS.RebindProtection.Allowlist {
+		if err := p.allow.add(rule); err != nil {
+			fmt.Printf("Skipping rebind allowlist rule %q: %v\n", rule, err)
+		}
+	}
+	return p
+}
+
+// nonPublicIP returns true if ip is not a globally reachable address.
+func nonPublicIP(ip net.IP) bool {
+	return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsUnspecified() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsLinkLocalMulticast() || sharedAddressSpace.Contains(ip) ||
+		(ip.To4() != nil && ip.To4()[0] == 0)
+}
+
+func nonPublicRR(rr dns.RR) bool {
+	switch rr := rr.(type) {
+	case *dns.A:
+		return nonPublicIP(rr.A)
+	case *dns.AAAA:
+		return nonPublicIP(rr.AAAA)
+	}
+	return false
+}
+
+// Filter removes records pointing at non-public addresses from the response
+// to a query for name, or refuses the response entirely if configured to.
+// It returns true if the response was modified.
+func (p *rebindProtection) Filter(name string, m *dns.Msg) bool {
+	var answer, extra []dns.RR
+	var found bool
+	for _, rr := range m.Answer {
+		if nonPublicRR(rr) {
+			found = true
+			continue
+		}
+		answer = append(answer, rr)
+	}
+	for _, rr := range m.Extra {
+		if nonPublicRR(rr) {
+			found = true
+			continue
+		}
+		extra = append(extra, rr)
+	}
+	if !found || p.allow.matches(strings.TrimSuffix(strings.ToLower(name), ".")) {
+		return false
+	}
+
+	if p.refuse {
+		m.Rcode = dns.RcodeRefused
+		m.Answer, m.Ns, extra = nil, nil, nil
+		for _, rr := range m.Extra {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				extra = append(extra, rr)
+			}
+		}
+	} else {
+		m.Answer = answer
+	}
+	m.Extra = extra
+	return true
+}
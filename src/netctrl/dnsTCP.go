@@ -0,0 +1,159 @@
+package netctrl
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	tcpIdleTimeout  = 10 * time.Second
+	tcpWriteTimeout = 2 * time.Second
+	// tcpMaxInflight bounds how many pipelined queries on a single
+	// connection are resolved at once.
+	tcpMaxInflight = 16
+	// maxUDPResponseSize caps the buffer size advertised by clients.
+	maxUDPResponseSize = dns.DefaultMsgSize
+)
+
+func (h *bridgeServices) setupTCPDNS(listenerIP string) error {
+	listener, err := net.Listen("tcp", net.JoinHostPort(listenerIP, "53"))
+	if err != nil {
+		return err
+	}
+	go h.serveTCPDNS(listener)
+	return nil
+}
+
+// serveTCPDNS accepts DNS-over-TCP connections. Unlike dns.Server, queries
+// pipelined on a connection are resolved concurrently and answered as soon
+// as each is ready, as RFC 7766 recommends.
+func (h *bridgeServices) serveTCPDNS(listener net.Listener) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			fmt.Printf("DNS TCP accept err: %v\n", err)
+			return
+		}
+		go h.serveTCPConn(conn)
+	}
+}
+
+func (h *bridgeServices) serveTCPConn(conn net.Conn) {
+	w := &tcpResponseWriter{conn: conn}
+	var wg sync.WaitGroup
+	defer conn.Close()
+	defer wg.Wait()
+
+	inflight := make(chan struct{}, tcpMaxInflight)
+	for {
+		conn.SetReadDeadline(time.Now().Add(tcpIdleTimeout))
+		var length uint16
+		if err := binary.Read(conn, binary.BigEndian, &length); err != nil {
+			return
+		}
+		buf := make([]byte, length)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+
+		r := new(dns.Msg)
+		if err := r.Unpack(buf); err != nil {
+			m := new(dns.Msg)
+			m.SetRcodeFormatError(r)
+			w.WriteMsg(m)
+			continue
+		}
+		if r.Response {
+			continue
+		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-inflight }()
+			h.ServeDNS(w, r)
+		}()
+	}
+}
+
+// tcpResponseWriter writes length-prefixed responses to a TCP connection,
+// which may be shared by concurrent handlers.
+type tcpResponseWriter struct {
+	lock sync.Mutex
+	conn net.Conn
+}
+
+func (w *tcpResponseWriter) LocalAddr() net.Addr  { return w.conn.LocalAddr() }
+func (w *tcpResponseWriter) RemoteAddr() net.Addr { return w.conn.RemoteAddr() }
+func (w *tcpResponseWriter) TsigStatus() error    { return nil }
+func (w *tcpResponseWriter) TsigTimersOnly(bool)  {}
+func (w *tcpResponseWriter) Hijack()              {}
+func (w *tcpResponseWriter) Close() error         { return w.conn.Close() }
+
+func (w *tcpResponseWriter) WriteMsg(m *dns.Msg) error {
+	d, err := m.Pack()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(d)
+	return err
+}
+
+func (w *tcpResponseWriter) Write(d []byte) (int, error) {
+	if len(d) > dns.MaxMsgSize {
+		return 0, fmt.Errorf("message too large: %d bytes", len(d))
+	}
+	buf := make([]byte, 2+len(d))
+	binary.BigEndian.PutUint16(buf, uint16(len(d)))
+	copy(buf[2:], d)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.conn.SetWriteDeadline(time.Now().Add(tcpWriteTimeout))
+	if _, err := w.conn.Write(buf); err != nil {
+		return 0, err
+	}
+	return len(d), nil
+}
+
+// udpResponseSize returns the largest response the client can receive over
+// UDP, from the buffer size it advertised with EDNS0 (RFC 6891 6.2.5).
+func udpResponseSize(r *dns.Msg) int {
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil && int(opt.UDPSize()) > size {
+		size = int(opt.UDPSize())
+	}
+	if size > maxUDPResponseSize {
+		size = maxUDPResponseSize
+	}
+	return size
+}
+
+// truncate strips records from a response which does not fit in size
+// bytes, and sets the TC bit so the client retries over TCP.
+func truncate(m *dns.Msg, size int) {
+	m.Compress = true
+	if m.Len() <= size {
+		return
+	}
+
+	var extra []dns.RR
+	for _, rr := range m.Extra {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			extra = append(extra, rr)
+		}
+	}
+	m.Answer, m.Ns, m.Extra = nil, nil, extra
+	m.Truncated = true
+}
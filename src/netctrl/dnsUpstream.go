@@ -0,0 +1,486 @@
+package netctrl
+
+import (
+	"bytes"
+	"config"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	dohMimeType         = "application/dns-message"
+	upstreamDialTimeout = 4 * time.Second
+	upstreamMaxFails    = 3
+	upstreamDownFor     = 30 * time.Second
+	maxDNSMessageSize   = 65535
+)
+
+var errNoUpstreams = errors.New("no DNS upstreams available")
+
+// dnsUpstream is a resolver DNS queries can be forwarded to.
+type dnsUpstream interface {
+	Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error)
+}
+
+// bootstrapDialer returns a dial function which connects to one of the
+// bootstrap IPs for a host, instead of resolving it. Hosts without any are
+// IP addresses, as the configuration requires.
+func bootstrapDialer(d *net.Dialer, bootstrap map[string][]string) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		ips := bootstrap[host]
+		if len(ips) == 0 {
+			return d.DialContext(ctx, network, addr)
+		}
+
+		for _, ip := range ips {
+			var conn net.Conn
+			if conn, err = d.DialContext(ctx, network, net.JoinHostPort(ip, port)); err == nil {
+				return conn, nil
+			}
+		}
+		return nil, err
+	}
+}
+
+// dohUpstream forwards queries using DNS-over-HTTPS (RFC 8484).
+type dohUpstream struct {
+	url    *url.URL
+	method string
+	client *http.Client
+}
+
+func newDOHUpstream(conf *config.DNSUpstream, client *http.Client) (*dohUpstream, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	return &dohUpstream{url: u, method: conf.Method, client: client}, nil
+}
+
+func (u *dohUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	// RFC 8484 4.1: the ID should be zero, to maximise cache friendliness.
+	q := m.Copy()
+	q.Id = 0
+	msg, err := q.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	var req *http.Request
+	if u.method == http.MethodGet {
+		reqURL := *u.url
+		v := reqURL.Query()
+		v.Set("dns", base64.RawURLEncoding.EncodeToString(msg))
+		reqURL.RawQuery = v.Encode()
+		req, err = http.NewRequest(http.MethodGet, reqURL.String(), nil)
+	} else {
+		req, err = http.NewRequest(http.MethodPost, u.url.String(), bytes.NewReader(msg))
+		if err == nil {
+			req.Header.Set("Content-Type", dohMimeType)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", dohMimeType)
+
+	resp, err := u.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("upstream returned status %d", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, dohMimeType) {
+		return nil, fmt.Errorf("upstream returned unexpected content type %q", ct)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxDNSMessageSize))
+	if err != nil {
+		return nil, err
+	}
+
+	out := new(dns.Msg)
+	if err := out.Unpack(body); err != nil {
+		return nil, err
+	}
+	out.Id = m.Id
+	return out, nil
+}
+
+// dotUpstream forwards queries using DNS-over-TLS (RFC 7858).
+type dotUpstream struct {
+	addrs  []string
+	dialer *net.Dialer
+	tls    *tls.Config
+}
+
+func newDOTUpstream(conf *config.DNSUpstream, d *net.Dialer) (*dotUpstream, error) {
+	u, err := url.Parse(conf.URL)
+	if err != nil {
+		return nil, err
+	}
+	port := u.Port()
+	if port == "" {
+		port = "853"
+	}
+
+	out := &dotUpstream{dialer: d, tls: &tls.Config{ServerName: u.Hostname()}}
+	for _, ip := range conf.Bootstrap {
+		out.addrs = append(out.addrs, net.JoinHostPort(ip, port))
+	}
+	if len(out.addrs) == 0 {
+		out.addrs = []string{net.JoinHostPort(u.Hostname(), port)}
+	}
+	return out, nil
+}
+
+func (u *dotUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	var err error
+	for _, addr := range u.addrs {
+		var r *dns.Msg
+		if r, err = u.exchange(ctx, m, addr); err == nil {
+			return r, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, err
+}
+
+func (u *dotUpstream) exchange(ctx context.Context, m *dns.Msg, addr string) (*dns.Msg, error) {
+	// dns.Client.ExchangeContext replaces the client's dialer, which would
+	// lose the binding to the tunnel, so the exchange is done by hand.
+	raw, err := u.dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn := tls.Client(raw, u.tls)
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return nil, err
+	}
+
+	co := &dns.Conn{Conn: conn}
+	if err := co.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	return co.ReadMsg()
+}
+
+// plainUpstream forwards queries using unencrypted DNS, over UDP with a
+// retry over TCP if the response is truncated.
+type plainUpstream struct {
+	addr   string
+	dialer *net.Dialer
+}
+
+func newPlainUpstream(conf *config.DNSUpstream, d *net.Dialer) *plainUpstream {
+	addr := strings.TrimPrefix(conf.URL, "udp://")
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	return &plainUpstream{addr: addr, dialer: d}
+}
+
+func (u *plainUpstream) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	r, err := u.exchange(ctx, m, "udp")
+	if err == nil && r.Truncated {
+		return u.exchange(ctx, m, "tcp")
+	}
+	return r, err
+}
+
+func (u *plainUpstream) exchange(ctx context.Context, m *dns.Msg, network string) (*dns.Msg, error) {
+	conn, err := u.dialer.DialContext(ctx, network, u.addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	co := &dns.Conn{Conn: conn, UDPSize: dns.DefaultMsgSize}
+	if err := co.WriteMsg(m); err != nil {
+		return nil, err
+	}
+	for {
+		r, err := co.ReadMsg()
+		// Ignore stray responses to other queries on UDP.
+		if err == nil && r.Id != m.Id {
+			continue
+		}
+		return r, err
+	}
+}
+
+// UpstreamStatus describes the health of a DNS upstream.
+type UpstreamStatus struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"consecutive_failures"`
+	LastError string    `json:"last_error,omitempty"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+type trackedUpstream struct {
+	conf      config.DNSUpstream
+	upstream  dnsUpstream
+	failures  int
+	lastErr   error
+	lastUsed  time.Time
+	downUntil time.Time
+}
+
+// upstreamPool forwards queries to the first healthy upstream, failing over
+// to the next one when an upstream errors.
+type upstreamPool struct {
+	lock      sync.Mutex
+	upstreams []*trackedUpstream
+	// transport is shared by all DNS-over-HTTPS upstreams, so connections
+	// are kept alive and multiplexed over HTTP/2.
+	transport *http.Transport
+}
+
+// newUpstreamPool creates a pool of the configured upstreams. If bindDevice
+// is not empty, all upstream connections are bound to that interface.
+func newUpstreamPool(confs []config.DNSUpstream, bindDevice string) (*upstreamPool, error) {
+	d := &net.Dialer{Timeout: upstreamDialTimeout, KeepAlive: 30 * time.Second}
+	if bindDevice != "" {
+		d.Control = BindToDevice(bindDevice)
+	}
+
+	bootstrap := map[string][]string{}
+	for _, conf := range confs {
+		if u, err := url.Parse(conf.URL); err == nil && u.Scheme == "https" {
+			bootstrap[u.Hostname()] = append(bootstrap[u.Hostname()], conf.Bootstrap...)
+		}
+	}
+	p := &upstreamPool{
+		transport: &http.Transport{
+			DialContext:         bootstrapDialer(d, bootstrap),
+			ForceAttemptHTTP2:   true,
+			TLSHandshakeTimeout: upstreamDialTimeout,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+	client := &http.Client{Transport: p.transport}
+
+	for i := range confs {
+		var u dnsUpstream
+		var err error
+		switch {
+		case strings.HasPrefix(confs[i].URL, "https://"):
+			u, err = newDOHUpstream(&confs[i], client)
+		case strings.HasPrefix(confs[i].URL, "tls://"):
+			u, err = newDOTUpstream(&confs[i], d)
+		default:
+			u = newPlainUpstream(&confs[i], d)
+		}
+		if err != nil {
+			return nil, err
+		}
+		p.upstreams = append(p.upstreams, &trackedUpstream{conf: confs[i], upstream: u})
+	}
+	return p, nil
+}
+
+// candidates returns upstreams in the order they should be tried. Upstreams
+// which have recently failed are tried last.
+func (p *upstreamPool) candidates() []*trackedUpstream {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	var healthy, down []*trackedUpstream
+	now := time.Now()
+	for _, u := range p.upstreams {
+		if now.Before(u.downUntil) {
+			down = append(down, u)
+		} else {
+			healthy = append(healthy, u)
+		}
+	}
+	return append(healthy, down...)
+}
+
+func (p *upstreamPool) record(u *trackedUpstream, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	u.lastUsed = time.Now()
+	u.lastErr = err
+	if err == nil {
+		u.failures = 0
+		u.downUntil = time.Time{}
+		return
+	}
+	u.failures++
+	if u.failures >= upstreamMaxFails {
+		u.downUntil = time.Now().Add(upstreamDownFor)
+	}
+}
+
+// Exchange forwards the query to an upstream, returning the response. Each
+// upstream is tried in turn until one succeeds or ctx expires.
+func (p *upstreamPool) Exchange(ctx context.Context, m *dns.Msg) (*dns.Msg, error) {
+	err := errNoUpstreams
+	for _, u := range p.candidates() {
+		var r *dns.Msg
+		r, err = u.upstream.Exchange(ctx, m)
+		p.record(u, err)
+		if err == nil {
+			return r, nil
+		}
+		fmt.Printf("DNS upstream %q failed: %v\n", u.conf.Name, err)
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+	}
+	return nil, err
+}
+
+// CloseIdleConnections closes connections kept open to upstreams, which is
+// necessary when the interface they were made on goes away.
+func (p *upstreamPool) CloseIdleConnections() {
+	p.transport.CloseIdleConnections()
+}
+
+// inflightCall is a query being forwarded upstream.
+type inflightCall struct {
+	done chan struct{}
+	resp *dns.Msg
+	err  error
+}
+
+// inflightGroup coalesces identical queries, so only one is forwarded
+// upstream at a time.
+type inflightGroup struct {
+	lock  sync.Mutex
+	calls map[cacheKey]*inflightCall
+}
+
+// Do calls fn, unless a call with the same key is already in flight, in
+// which case its result is waited for until ctx expires. The result is
+// shared, so fn must not depend on the caller's context, and callers must
+// copy the response before modifying it.
+func (g *inflightGroup) Do(ctx context.Context, key cacheKey, fn func() (*dns.Msg, error)) (*dns.Msg, error) {
+	g.lock.Lock()
+	if g.calls == nil {
+		g.calls = map[cacheKey]*inflightCall{}
+	}
+	if c, ok := g.calls[key]; ok {
+		g.lock.Unlock()
+		select {
+		case <-c.done:
+			return c.resp, c.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	c := &inflightCall{done: make(chan struct{})}
+	g.calls[key] = c
+	g.lock.Unlock()
+
+	c.resp, c.err = fn()
+	g.lock.Lock()
+	delete(g.calls, key)
+	g.lock.Unlock()
+	close(c.done)
+	return c.resp, c.err
+}
+
+// clientLimiter caps the number of upstream queries each client can have
+// outstanding at once.
+type clientLimiter struct {
+	lock    sync.Mutex
+	max     int
+	clients map[string]*clientSlots
+}
+
+// clientSlots are the slots of one client. refs counts the queries holding
+// or waiting for a slot, and the entry is removed once it drops to zero.
+type clientSlots struct {
+	sem  chan struct{}
+	refs int
+}
+
+func newClientLimiter(max int) *clientLimiter {
+	return &clientLimiter{max: max, clients: map[string]*clientSlots{}}
+}
+
+// Acquire waits for a free slot for the client, returning a function which
+// releases it.
+func (l *clientLimiter) Acquire(ctx context.Context, client string) (func(), error) {
+	l.lock.Lock()
+	slots, ok := l.clients[client]
+	if !ok {
+		slots = &clientSlots{sem: make(chan struct{}, l.max)}
+		l.clients[client] = slots
+	}
+	slots.refs++
+	l.lock.Unlock()
+
+	select {
+	case slots.sem <- struct{}{}:
+	case <-ctx.Done():
+		l.unref(client, slots)
+		return nil, ctx.Err()
+	}
+	return func() {
+		<-slots.sem
+		l.unref(client, slots)
+	}, nil
+}
+
+func (l *clientLimiter) unref(client string, slots *clientSlots) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if slots.refs--; slots.refs == 0 {
+		delete(l.clients, client)
+	}
+}
+
+// Status returns the health of each upstream.
+func (p *upstreamPool) Status() []UpstreamStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	out := make([]UpstreamStatus, len(p.upstreams))
+	for i, u := range p.upstreams {
+		out[i] = UpstreamStatus{
+			Name:     u.conf.Name,
+			URL:      u.conf.URL,
+			Healthy:  time.Now().After(u.downUntil),
+			Failures: u.failures,
+			LastUsed: u.lastUsed,
+		}
+		if u.lastErr != nil {
+			out[i].LastError = u.lastErr.Error()
+		}
+	}
+	return out
+}
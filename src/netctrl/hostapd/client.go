@@ -0,0 +1,237 @@
+package hostapd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// requestTimeout bounds how long a request waits for its reply.
+	requestTimeout = 2 * time.Second
+	// pingInterval is how often the connection is checked, so a restarted
+	// hostapd is noticed and reattached to.
+	pingInterval = 5 * time.Second
+	// Reconnection attempts back off from minReconnectDelay, doubling up
+	// to maxReconnectDelay.
+	minReconnectDelay = 250 * time.Millisecond
+	maxReconnectDelay = 10 * time.Second
+)
+
+// EventAttached is published by the client itself each time it attaches to
+// hostapd, which may have been restarted in the meantime.
+const EventAttached = "ATTACHED"
+
+var (
+	errNotConnected = errors.New("hostapd: not connected")
+	errTimeout      = errors.New("hostapd: timeout waiting for reply")
+	errClosed       = errors.New("hostapd: client closed")
+
+	eventRe = regexp.MustCompile(`^<([0-9])>`)
+)
+
+// Event is an unsolicited message from hostapd, such as
+// "<3>AP-STA-CONNECTED 02:11:22:33:44:55".
+type Event struct {
+	// Interface is the interface whose control socket sent the event.
+	Interface string
+	Level     int
+	Name      string
+	Args      []string
+}
+
+func parseEvent(iface string, msg []byte) (Event, bool) {
+	m := eventRe.FindSubmatch(msg)
+	if m == nil {
+		return Event{}, false
+	}
+	level, _ := strconv.Atoi(string(m[1]))
+	f := strings.Fields(string(msg[len(m[0]):]))
+	if len(f) == 0 {
+		return Event{}, false
+	}
+	return Event{Interface: iface, Level: level, Name: f[0], Args: f[1:]}, true
+}
+
+// Client is a long-lived connection to a hostapd control socket. It
+// attaches to receive events, and reconnects if hostapd restarts. It is
+// safe for concurrent use.
+type Client struct {
+	sock   string
+	iface  string
+	events chan<- Event
+
+	// reqLock serializes requests, as hostapd replies in order and
+	// replies carry nothing to match them to requests.
+	reqLock sync.Mutex
+	replies chan []byte
+
+	connLock sync.Mutex
+	conn     *net.UnixConn
+
+	closing chan struct{}
+	done    chan struct{}
+}
+
+// NewClient connects to the hostapd control socket at sock, and publishes
+// events to events. Events are dropped if the channel is full, so the
+// connection never stalls.
+func NewClient(sock string, events chan<- Event) *Client {
+	c := &Client{
+		sock:    sock,
+		iface:   filepath.Base(sock),
+		events:  events,
+		replies: make(chan []byte, 1),
+		closing: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go c.run()
+	return c
+}
+
+// Close disconnects from hostapd.
+func (c *Client) Close() error {
+	close(c.closing)
+	<-c.done
+	return nil
+}
+
+func (c *Client) publish(e Event) {
+	select {
+	case c.events <- e:
+	default:
+	}
+}
+
+func (c *Client) run() {
+	defer close(c.done)
+	delay := minReconnectDelay
+	for {
+		if attached, _ := c.session(); attached {
+			delay = minReconnectDelay
+		}
+		select {
+		case <-c.closing:
+			return
+		case <-time.After(delay):
+		}
+		if delay *= 2; delay > maxReconnectDelay {
+			delay = maxReconnectDelay
+		}
+	}
+}
+
+// session connects and attaches to hostapd, and returns once the
+// connection fails or the client is closed.
+func (c *Client) session() (attached bool, err error) {
+	local := randStringFname()
+	conn, err := net.DialUnix("unixgram", &net.UnixAddr{Name: local, Net: "unixgram"}, &net.UnixAddr{Name: c.sock, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	readErr := make(chan error, 1)
+	go c.readLoop(conn, readErr)
+	c.connLock.Lock()
+	c.conn = conn
+	c.connLock.Unlock()
+	defer func() {
+		c.connLock.Lock()
+		c.conn = nil
+		c.connLock.Unlock()
+		conn.Close()
+		os.Remove(local)
+	}()
+
+	if err := c.expect("ATTACH", "OK"); err != nil {
+		return false, err
+	}
+	c.publish(Event{Interface: c.iface, Name: EventAttached})
+
+	t := time.NewTicker(pingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.closing:
+			return true, errClosed
+		case err := <-readErr:
+			return true, err
+		case <-t.C:
+			if err := c.expect("PING", "PONG"); err != nil {
+				return true, err
+			}
+		}
+	}
+}
+
+// readLoop receives messages until the connection is closed, passing on
+// replies to the pending request and publishing events.
+func (c *Client) readLoop(conn *net.UnixConn, readErr chan<- error) {
+	buff := make([]byte, maxResponseSize)
+	for {
+		n, err := conn.Read(buff)
+		if err != nil {
+			readErr <- err
+			return
+		}
+		if e, ok := parseEvent(c.iface, buff[:n]); ok {
+			c.publish(e)
+			continue
+		}
+		msg := append([]byte(nil), buff[:n]...)
+		select {
+		case c.replies <- msg:
+		default:
+		}
+	}
+}
+
+// Request sends a command to hostapd, and returns its reply.
+func (c *Client) Request(cmd string) ([]byte, error) {
+	c.reqLock.Lock()
+	defer c.reqLock.Unlock()
+
+	c.connLock.Lock()
+	conn := c.conn
+	c.connLock.Unlock()
+	if conn == nil {
+		return nil, errNotConnected
+	}
+
+	// Discard any reply to an earlier request which timed out.
+	select {
+	case <-c.replies:
+	default:
+	}
+	if _, err := conn.Write([]byte(cmd)); err != nil {
+		return nil, err
+	}
+
+	t := time.NewTimer(requestTimeout)
+	defer t.Stop()
+	select {
+	case msg := <-c.replies:
+		return msg, nil
+	case <-t.C:
+		return nil, errTimeout
+	case <-c.closing:
+		return nil, errClosed
+	}
+}
+
+// expect sends a command, and checks its reply.
+func (c *Client) expect(cmd, want string) error {
+	resp, err := c.Request(cmd)
+	if err != nil {
+		return err
+	}
+	if r := strings.TrimSpace(string(resp)); r != want {
+		return errors.New("hostapd: " + cmd + ": " + r)
+	}
+	return nil
+}
@@ -3,49 +3,437 @@ package hostapd
 import (
 	"bytes"
 	"config"
-	"html/template"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
-var baseConfigTmpl = template.Must(template.New("name").Parse(`
-interface={{.WlanInterface}}
-driver={{.HostapdDriver}}
-
-ssid={{.SSID}}
-hw_mode=g
-channel=7
-wmm_enabled=0
-macaddr_acl=0
-auth_algs=1
-ignore_broadcast_ssid=0
-wpa=2
-wpa_passphrase={{.Passphrase}}
-wpa_key_mgmt=WPA-PSK
-wpa_pairwise=TKIP
-rsn_pairwise=CCMP
-
-bridge={{.BridgeName}}
-ctrl_interface=/var/run/hostapd`))
+var (
+	capabRe     = regexp.MustCompile(`^(\[[A-Z0-9+\-]+\])*$`)
+	countryRe   = regexp.MustCompile(`^[A-Z]{2}$`)
+	optionKeyRe = regexp.MustCompile(`^[a-z][a-z0-9_\[\]]*$`)
+	hexPSKRe    = regexp.MustCompile(`^[0-9a-fA-F]{64}$`)
+	interfaceRe = regexp.MustCompile(`^[a-zA-Z0-9_.\-]{1,15}$`)
+	driverRe    = regexp.MustCompile(`^[a-z0-9_]+$`)
+)
+
+// configWriter builds a hostapd configuration file, which is a list of
+// key=value lines.
+type configWriter struct {
+	b    bytes.Buffer
+	keys map[string]bool
+}
+
+// set writes a line to the configuration. Values cannot span lines, as
+// hostapd would treat the remainder as another setting.
+func (w *configWriter) set(key string, value interface{}) error {
+	v := fmt.Sprint(value)
+	if strings.ContainsAny(v, "\r\n\x00") {
+		return fmt.Errorf("%s: value cannot contain line breaks", key)
+	}
+	if w.keys == nil {
+		w.keys = map[string]bool{}
+	}
+	w.keys[key] = true
+	fmt.Fprintf(&w.b, "%s=%s\n", key, v)
+	return nil
+}
+
+// setAll writes each setting in order, stopping at the first error.
+func (w *configWriter) setAll(settings ...interface{}) error {
+	for i := 0; i+1 < len(settings); i += 2 {
+		if err := w.set(settings[i].(string), settings[i+1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// validateSSID checks the SSID is 1-32 bytes, without control characters.
+func validateSSID(ssid string) error {
+	if ssid == "" {
+		return errors.New("SSID must be specified")
+	}
+	if len(ssid) > 32 {
+		return fmt.Errorf("SSID %q is longer than 32 bytes", ssid)
+	}
+	for _, r := range ssid {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return fmt.Errorf("SSID %q contains an invalid character", ssid)
+		}
+	}
+	return nil
+}
+
+// validatePassphrase checks a WPA passphrase is 8-63 printable ASCII
+// characters, or a 64 digit hex PSK.
+func validatePassphrase(p string) error {
+	if hexPSKRe.MatchString(p) {
+		return nil
+	}
+	if len(p) < 8 || len(p) > 63 {
+		return errors.New("password must be between 8 and 63 characters")
+	}
+	for _, r := range p {
+		if r < 32 || r > 126 {
+			return errors.New("password must contain only printable ASCII characters")
+		}
+	}
+	return nil
+}
+
+// hwModeForBand returns the hw_mode and default channel for a band.
+func hwModeForBand(band string) (string, int, error) {
+	switch band {
+	case "2.4":
+		return "g", 7, nil
+	case "5":
+		return "a", 36, nil
+	}
+	return "", 0, fmt.Errorf("unsupported band %q, must be 2.4 or 5", band)
+}
+
+func validateChannel(hwMode string, channel int) error {
+	switch hwMode {
+	case "b", "g":
+		if channel < 1 || channel > 14 {
+			return fmt.Errorf("channel %d is not a 2.4GHz channel", channel)
+		}
+	case "a":
+		if channel < 32 || channel > 177 {
+			return fmt.Errorf("channel %d is not a 5GHz channel", channel)
+		}
+	case "ad":
+		if channel < 1 || channel > 6 {
+			return fmt.Errorf("channel %d is not a 60GHz channel", channel)
+		}
+	default:
+		return fmt.Errorf("unsupported hw_mode %q", hwMode)
+	}
+	return nil
+}
+
+// writeRadio writes the settings for the radio: band, channel and
+// 802.11n/ac capabilities.
+func writeRadio(w *configWriter, c *config.Config) error {
+	wl := &c.Network.Wireless
+
+	hwMode, channel, err := hwModeForBand(wl.Band)
+	if err != nil {
+		return err
+	}
+	if wl.HWMode != "" {
+		hwMode = wl.HWMode
+	}
+	if wl.Channel != 0 {
+		channel = wl.Channel
+	}
+	if err := validateChannel(hwMode, channel); err != nil {
+		return err
+	}
+	var channelSetting interface{} = channel
+	if wl.ACS {
+		// hostapd surveys the channels when it starts, and picks one.
+		channelSetting = "acs_survey"
+	}
+	if err := w.setAll("hw_mode", hwMode, "channel", channelSetting); err != nil {
+		return err
+	}
+
+	if wl.CountryCode != "" {
+		if !countryRe.MatchString(wl.CountryCode) {
+			return fmt.Errorf("invalid country code %q", wl.CountryCode)
+		}
+		if err := w.setAll("country_code", wl.CountryCode, "ieee80211d", 1); err != nil {
+			return err
+		}
+		if hwMode == "a" {
+			// Required for DFS channels.
+			if err := w.set("ieee80211h", 1); err != nil {
+				return err
+			}
+		}
+	}
+
+	if wl.IEEE80211N {
+		if err := w.set("ieee80211n", 1); err != nil {
+			return err
+		}
+		if wl.HTCapab != "" {
+			if !capabRe.MatchString(wl.HTCapab) {
+				return fmt.Errorf("invalid ht_capab %q", wl.HTCapab)
+			}
+			if err := w.set("ht_capab", wl.HTCapab); err != nil {
+				return err
+			}
+		}
+	} else if wl.HTCapab != "" {
+		return errors.New("ht_capab requires ieee80211n")
+	}
+
+	if wl.IEEE80211AC {
+		if hwMode != "a" {
+			return errors.New("ieee80211ac requires the 5GHz band")
+		}
+		if err := w.set("ieee80211ac", 1); err != nil {
+			return err
+		}
+		if wl.VHTCapab != "" {
+			if !capabRe.MatchString(wl.VHTCapab) {
+				return fmt.Errorf("invalid vht_capab %q", wl.VHTCapab)
+			}
+			if err := w.set("vht_capab", wl.VHTCapab); err != nil {
+				return err
+			}
+		}
+		if wl.VHTChannelWidth < 0 || wl.VHTChannelWidth > 3 {
+			return fmt.Errorf("invalid vht_oper_chwidth %d, must be 0-3", wl.VHTChannelWidth)
+		}
+		if err := w.set("vht_oper_chwidth", wl.VHTChannelWidth); err != nil {
+			return err
+		}
+		if wl.VHTCenterFreq != 0 {
+			if err := validateChannel("a", wl.VHTCenterFreq); err != nil {
+				return fmt.Errorf("vht_oper_centr_freq_seg0_idx: %v", err)
+			}
+			if err := w.set("vht_oper_centr_freq_seg0_idx", wl.VHTCenterFreq); err != nil {
+				return err
+			}
+		}
+	} else if wl.VHTCapab != "" || wl.VHTChannelWidth != 0 || wl.VHTCenterFreq != 0 {
+		return errors.New("vht settings require ieee80211ac")
+	}
+
+	wmm := wl.IEEE80211N || wl.IEEE80211AC
+	if wl.WMM != nil {
+		wmm = *wl.WMM
+	}
+	if !wmm && (wl.IEEE80211N || wl.IEEE80211AC) {
+		return errors.New("wmm is required for 802.11n and 802.11ac")
+	}
+	if wl.BeaconInterval < 15 || wl.BeaconInterval > 65535 {
+		return fmt.Errorf("invalid beacon_interval %d, must be 15-65535", wl.BeaconInterval)
+	}
+	return w.setAll("wmm_enabled", boolInt(wmm), "beacon_int", wl.BeaconInterval)
+}
+
+// bssSettings describes a single SSID.
+type bssSettings struct {
+	SSID, Password string
+	Security, PMF  string
+	Hidden         bool
+	// MACAllowlist only admits stations on the accept list.
+	MACAllowlist bool
+}
+
+func primaryBSS(c *config.Config) *bssSettings {
+	wl := &c.Network.Wireless
+	return &bssSettings{SSID: wl.SSID, Password: wl.Password, Security: wl.Security, PMF: wl.PMF, Hidden: wl.Hidden, MACAllowlist: wl.MACAllowlist}
+}
+
+// writeSecurity writes the settings for an SSID and its authentication.
+func writeSecurity(w *configWriter, b *bssSettings) error {
+	if err := validateSSID(b.SSID); err != nil {
+		return err
+	}
+	if err := w.set("ssid", b.SSID); err != nil {
+		return err
+	}
+	if !isASCII(b.SSID) {
+		if err := w.set("utf8_ssid", 1); err != nil {
+			return err
+		}
+	}
+	if err := w.setAll("ignore_broadcast_ssid", boolInt(b.Hidden), "macaddr_acl", boolInt(b.MACAllowlist), "auth_algs", 1); err != nil {
+		return err
+	}
+
+	var keyMgmt, defaultPMF string
+	switch b.Security {
+	case "open":
+		if b.Password != "" {
+			return errors.New("password cannot be set for an open network")
+		}
+		if b.PMF != "" && b.PMF != "disabled" {
+			return errors.New("pmf requires WPA2 or WPA3")
+		}
+		return nil
+	case "wpa2":
+		keyMgmt, defaultPMF = "WPA-PSK", "disabled"
+	case "wpa3":
+		keyMgmt, defaultPMF = "SAE", "required"
+	case "wpa2-wpa3":
+		keyMgmt, defaultPMF = "WPA-PSK SAE", "optional"
+	default:
+		return fmt.Errorf("unsupported security %q, must be one of wpa2, wpa3, wpa2-wpa3 or open", b.Security)
+	}
+
+	pmf := b.PMF
+	if pmf == "" {
+		pmf = defaultPMF
+	}
+	var ieee80211w int
+	switch pmf {
+	case "disabled":
+	case "optional":
+		ieee80211w = 1
+	case "required":
+		ieee80211w = 2
+	default:
+		return fmt.Errorf("unsupported pmf %q, must be one of disabled, optional or required", pmf)
+	}
+	// WPA3 requires PMF, and transition mode must allow WPA2 clients
+	// which do not support it.
+	if b.Security == "wpa3" && ieee80211w != 2 {
+		return errors.New("wpa3 requires pmf to be required")
+	}
+	if b.Security == "wpa2-wpa3" && ieee80211w != 1 {
+		return errors.New("wpa2-wpa3 requires pmf to be optional")
+	}
+
+	if err := validatePassphrase(b.Password); err != nil {
+		return err
+	}
+	pskKey := "wpa_passphrase"
+	if hexPSKRe.MatchString(b.Password) {
+		if b.Security != "wpa2" {
+			return errors.New("SAE requires a passphrase, not a hex PSK")
+		}
+		pskKey = "wpa_psk"
+	}
+	return w.setAll(
+		"wpa", 2,
+		pskKey, b.Password,
+		"wpa_key_mgmt", keyMgmt,
+		"rsn_pairwise", "CCMP",
+		"ieee80211w", ieee80211w,
+	)
+}
+
+// writeWPS enables push-button WPS, which hostapd only supports with a
+// WPA2 passphrase on a visible SSID.
+func writeWPS(w *configWriter, b *bssSettings) error {
+	if b.Security != "wpa2" && b.Security != "wpa2-wpa3" {
+		return errors.New("wps requires wpa2 or wpa2-wpa3 security")
+	}
+	if b.Hidden {
+		return errors.New("wps cannot be used with a hidden SSID")
+	}
+	return w.setAll("wps_state", 2, "eap_server", 1, "config_methods", "push_button")
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// writeOptions writes the passthrough options, in a stable order. They
+// cannot replace settings which are generated.
+func writeOptions(w *configWriter, opts map[string]string) error {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !optionKeyRe.MatchString(k) {
+			return fmt.Errorf("invalid hostapd option %q", k)
+		}
+		if w.keys[k] {
+			return fmt.Errorf("hostapd option %q is already set, use the wireless setting instead", k)
+		}
+		if err := w.set(k, opts[k]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
 // GenerateConfig creates hostapd configuration.
 func GenerateConfig(c *config.Config) (string, error) {
-	var b bytes.Buffer
-
-	data := struct {
-		SSID          string
-		WlanInterface string
-		Passphrase    string
-		BridgeName    string
-		HostapdDriver string
-	}{
-		SSID:          c.Network.Wireless.SSID,
-		WlanInterface: c.Network.Wireless.Interface,
-		Passphrase:    c.Network.Wireless.Password,
-		BridgeName:    "br" + c.Network.InterfaceIdent,
-		HostapdDriver: c.Network.Wireless.HostapdDriver,
-	}
-
-	if err := baseConfigTmpl.Execute(&b, &data); err != nil {
+	var w configWriter
+	wl := &c.Network.Wireless
+
+	if !interfaceRe.MatchString(wl.Interface) {
+		return "", fmt.Errorf("invalid wireless interface %q", wl.Interface)
+	}
+	if !driverRe.MatchString(wl.HostapdDriver) {
+		return "", fmt.Errorf("invalid hostapd driver %q", wl.HostapdDriver)
+	}
+	if err := w.setAll("interface", wl.Interface, "driver", wl.HostapdDriver); err != nil {
+		return "", err
+	}
+	if err := writeRadio(&w, c); err != nil {
+		return "", err
+	}
+	if err := writeSecurity(&w, primaryBSS(c)); err != nil {
+		return "", err
+	}
+	if wl.WPS {
+		if err := writeWPS(&w, primaryBSS(c)); err != nil {
+			return "", err
+		}
+	}
+	if err := w.setAll("bridge", "br"+c.Network.InterfaceIdent, "ctrl_interface", "/var/run/hostapd"); err != nil {
+		return "", err
+	}
+	// Options must come before any bss section, or they would only apply
+	// to the last SSID.
+	if err := writeOptions(&w, wl.HostapdOptions); err != nil {
 		return "", err
 	}
-	return b.String(), nil
+
+	for i, n := range wl.Networks {
+		if err := w.set("bss", config.NetworkInterfaceName(c, i)); err != nil {
+			return "", err
+		}
+		if n.BSSID != "" {
+			if err := w.set("bssid", n.BSSID); err != nil {
+				return "", err
+			}
+		}
+		b := &bssSettings{SSID: n.SSID, Password: n.Password, Security: n.Security, PMF: n.PMF, Hidden: n.Hidden, MACAllowlist: wl.MACAllowlist}
+		if err := writeSecurity(&w, b); err != nil {
+			return "", fmt.Errorf("network %q: %v", n.Name, err)
+		}
+		if err := w.set("bridge", config.NetworkBridgeName(c, i)); err != nil {
+			return "", err
+		}
+	}
+	return w.b.String(), nil
+}
+
+// Setting is a hostapd configuration setting.
+type Setting struct {
+	Key, Value string
+}
+
+// PrimarySettings returns the settings for the primary SSID and its
+// authentication, which can be changed on a running hostapd with SET.
+func PrimarySettings(c *config.Config) ([]Setting, error) {
+	var w configWriter
+	if err := writeSecurity(&w, primaryBSS(c)); err != nil {
+		return nil, err
+	}
+	var out []Setting
+	for _, line := range strings.Split(strings.TrimSuffix(w.b.String(), "\n"), "\n") {
+		i := strings.Index(line, "=")
+		out = append(out, Setting{Key: line[:i], Value: line[i+1:]})
+	}
+	return out, nil
 }
@@ -0,0 +1,65 @@
+package hostapd
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// macCommand sends a command which takes a MAC address, and which hostapd
+// answers with OK or FAIL.
+func (c *Client) macCommand(cmd, mac string) error {
+	addr, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	return c.expect(cmd+" "+addr.String(), "OK")
+}
+
+// Deauthenticate disconnects a station. It may reconnect.
+func (c *Client) Deauthenticate(mac string) error {
+	return c.macCommand("DEAUTHENTICATE", mac)
+}
+
+// Disassociate disconnects a station, but leaves it authenticated, so it
+// can reassociate quickly.
+func (c *Client) Disassociate(mac string) error {
+	return c.macCommand("DISASSOCIATE", mac)
+}
+
+// DenyMAC adds a station to the deny list, disconnecting it if it is
+// associated.
+func (c *Client) DenyMAC(mac string) error {
+	return c.macCommand("DENY_ACL ADD_MAC", mac)
+}
+
+// UndenyMAC removes a station from the deny list.
+func (c *Client) UndenyMAC(mac string) error {
+	return c.macCommand("DENY_ACL DEL_MAC", mac)
+}
+
+// AcceptMAC adds a station to the accept list, which is only consulted when
+// macaddr_acl is 1.
+func (c *Client) AcceptMAC(mac string) error {
+	return c.macCommand("ACCEPT_ACL ADD_MAC", mac)
+}
+
+// UnacceptMAC removes a station from the accept list, disconnecting it if
+// it is associated.
+func (c *Client) UnacceptMAC(mac string) error {
+	return c.macCommand("ACCEPT_ACL DEL_MAC", mac)
+}
+
+// Apply changes settings on the running hostapd, then reloads the
+// interface so they take effect. Stations are disconnected.
+func (c *Client) Apply(settings []Setting) error {
+	for _, s := range settings {
+		if strings.ContainsAny(s.Key+s.Value, "\r\n\x00") {
+			return fmt.Errorf("%s: value cannot contain line breaks", s.Key)
+		}
+		if err := c.expect("SET "+s.Key+" "+s.Value, "OK"); err != nil {
+			return err
+		}
+	}
+	return c.expect("RELOAD", "OK")
+}
@@ -24,9 +24,9 @@ func atoiAlways(num string) int {
 	return v
 }
 
-// QueryStatus returns the status of the hostapd service.
-func QueryStatus(sock string) (*APStatus, error) {
-	raw, err := Query(sock, "STATUS")
+// Status returns the status of the hostapd service.
+func (c *Client) Status() (*APStatus, error) {
+	raw, err := c.Request("STATUS")
 	if err != nil {
 		return nil, err
 	}
@@ -46,7 +46,8 @@ func QueryStatus(sock string) (*APStatus, error) {
 	}, nil
 }
 
-// Query sends a request to the hostapd socket at sock.
+// Query sends a single request to the hostapd socket at sock, without
+// keeping a connection open.
 func Query(sock, command string) ([]byte, error) {
 	lf := randStringFname()
 	defer os.Remove(lf)
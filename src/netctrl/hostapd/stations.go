@@ -0,0 +1,123 @@
+package hostapd
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// maxStations bounds how many stations are walked, in case hostapd keeps
+// returning the same one.
+const maxStations = 2048
+
+// Station represents a client associated with the access point.
+type Station struct {
+	MAC       string `json:"mac"`
+	Interface string `json:"interface,omitempty"`
+	AID       int    `json:"aid"`
+	// Signal is the signal strength of the last frame received, in dBm.
+	Signal int `json:"signal"`
+	// RxRate and TxRate are the bitrates of the last frames received from
+	// and sent to the station, in kbit/s.
+	RxRate int `json:"rx_rate_kbps"`
+	TxRate int `json:"tx_rate_kbps"`
+
+	RxBytes   uint64 `json:"rx_bytes"`
+	TxBytes   uint64 `json:"tx_bytes"`
+	RxPackets uint64 `json:"rx_packets"`
+	TxPackets uint64 `json:"tx_packets"`
+
+	// ConnectedSecs is how long the station has been associated, and
+	// InactiveMsec how long since it was last active.
+	ConnectedSecs int `json:"connected_secs"`
+	InactiveMsec  int `json:"inactive_msec"`
+
+	// Flags are hostapd's station flags, such as AUTHORIZED, WMM or HT.
+	Flags []string `json:"flags"`
+}
+
+// Stations returns the stations associated with the access point.
+func (c *Client) Stations() ([]*Station, error) {
+	var out []*Station
+	raw, err := c.Request("STA-FIRST")
+	for len(out) < maxStations {
+		if err != nil {
+			return nil, err
+		}
+		sta := parseStation(string(raw))
+		if sta == nil {
+			break
+		}
+		out = append(out, sta)
+		raw, err = c.Request("STA-NEXT " + sta.MAC)
+	}
+	return out, nil
+}
+
+// parseStation parses the response to STA-FIRST or STA-NEXT: the station's
+// MAC address, followed by key=value lines. It returns nil once there are
+// no more stations.
+func parseStation(raw string) *Station {
+	lines := strings.Split(strings.TrimSpace(raw), "\n")
+	if _, err := net.ParseMAC(strings.TrimSpace(lines[0])); err != nil {
+		return nil
+	}
+	s := &Station{MAC: strings.ToLower(strings.TrimSpace(lines[0])), Flags: []string{}}
+	for _, line := range lines[1:] {
+		i := strings.Index(line, "=")
+		if i < 1 {
+			continue
+		}
+		key, val := line[:i], strings.TrimSpace(line[i+1:])
+		switch key {
+		case "aid":
+			s.AID = atoiAlways(val)
+		case "signal":
+			s.Signal = atoiAlways(val)
+		case "rx_rate_info":
+			s.RxRate = parseRate(val)
+		case "tx_rate_info":
+			s.TxRate = parseRate(val)
+		case "rx_bytes":
+			s.RxBytes = parseUintAlways(val)
+		case "tx_bytes":
+			s.TxBytes = parseUintAlways(val)
+		case "rx_packets":
+			s.RxPackets = parseUintAlways(val)
+		case "tx_packets":
+			s.TxPackets = parseUintAlways(val)
+		case "connected_time":
+			s.ConnectedSecs = atoiAlways(val)
+		case "inactive_msec":
+			s.InactiveMsec = atoiAlways(val)
+		case "flags":
+			s.Flags = parseFlags(val)
+		}
+	}
+	return s
+}
+
+// parseRate parses a rate such as "650 mcs 7 shortGI", whose first field is
+// in units of 100 kbit/s.
+func parseRate(val string) int {
+	if f := strings.Fields(val); len(f) > 0 {
+		return atoiAlways(f[0]) * 100
+	}
+	return 0
+}
+
+// parseFlags parses flags such as "[AUTH][ASSOC][AUTHORIZED]".
+func parseFlags(val string) []string {
+	out := []string{}
+	for _, f := range strings.Split(val, "]") {
+		if f = strings.TrimPrefix(f, "["); f != "" {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func parseUintAlways(num string) uint64 {
+	v, _ := strconv.ParseUint(num, 10, 64)
+	return v
+}
@@ -0,0 +1,48 @@
+package hostapd
+
+import "strings"
+
+// WPSStatus is the state of WPS push-button configuration.
+type WPSStatus struct {
+	// PBCStatus is "Active", "Disabled", "Timed-out" or "Overlap".
+	PBCStatus string `json:"pbc_status"`
+	// LastResult is "None", "Success" or "Failed".
+	LastResult  string `json:"last_result"`
+	PeerAddress string `json:"peer_address,omitempty"`
+}
+
+// WPSPushButton starts push-button configuration, letting a device which
+// has its button pushed join the network.
+func (c *Client) WPSPushButton() error {
+	return c.expect("WPS_PBC", "OK")
+}
+
+// WPSCancel stops push-button configuration.
+func (c *Client) WPSCancel() error {
+	return c.expect("WPS_CANCEL", "OK")
+}
+
+// WPSStatus returns the state of push-button configuration.
+func (c *Client) WPSStatus() (*WPSStatus, error) {
+	raw, err := c.Request("WPS_GET_STATUS")
+	if err != nil {
+		return nil, err
+	}
+	out := &WPSStatus{}
+	for _, line := range strings.Split(string(raw), "\n") {
+		i := strings.Index(line, ":")
+		if i < 1 {
+			continue
+		}
+		val := strings.TrimSpace(line[i+1:])
+		switch line[:i] {
+		case "PBC Status":
+			out.PBCStatus = val
+		case "Last WPS result":
+			out.LastResult = val
+		case "Peer Address":
+			out.PeerAddress = val
+		}
+	}
+	return out, nil
+}
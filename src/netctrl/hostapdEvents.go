@@ -0,0 +1,62 @@
+package netctrl
+
+import (
+	"fmt"
+	"netctrl/hostapd"
+)
+
+// startHostapdClients connects to the control socket of each SSID.
+func (c *Controller) startHostapdClients() {
+	c.hostapdEvents = make(chan hostapd.Event, 64)
+	c.hostapdClients = map[string]*hostapd.Client{}
+	for _, iface := range c.hostapdInterfaces() {
+		c.hostapdClients[iface] = hostapd.NewClient("/var/run/hostapd/"+iface, c.hostapdEvents)
+	}
+}
+
+func (c *Controller) closeHostapdClients() {
+	c.apLock.Lock()
+	if c.wpsTimer != nil {
+		c.wpsTimer.Stop()
+	}
+	c.apLock.Unlock()
+	for _, h := range c.hostapdClients {
+		h.Close()
+	}
+}
+
+// hostapdEventRoutine updates state as soon as hostapd reports a change.
+func (c *Controller) hostapdEventRoutine() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case e := <-c.hostapdEvents:
+			c.handleHostapdEvent(e)
+		}
+	}
+}
+
+func (c *Controller) handleHostapdEvent(e hostapd.Event) {
+	if c.config.Debug.Hostapd {
+		fmt.Printf("hostapd event on %s: %s %v\n", e.Interface, e.Name, e.Args)
+	}
+
+	switch e.Name {
+	case hostapd.EventAttached:
+		// hostapd may have restarted, losing its deny and accept lists.
+		if err := c.applyStationACL(c.hostapdClients[e.Interface]); err != nil {
+			fmt.Printf("Failed to apply station ACL on %s: %v\n", e.Interface, err)
+		}
+		c.refreshAPStatus()
+		c.refreshStations()
+		c.refreshWPS()
+	case "AP-STA-CONNECTED", "AP-STA-DISCONNECTED":
+		c.refreshStations()
+	case "AP-ENABLED", "AP-DISABLED":
+		c.refreshAPStatus()
+	case "WPS-PBC-ACTIVE", "WPS-PBC-DISABLE", "WPS-SUCCESS", "WPS-FAIL", "WPS-TIMEOUT", "WPS-OVERLAP-DETECTED":
+		c.refreshWPS()
+	}
+}
@@ -0,0 +1,158 @@
+package netctrl
+
+import (
+	"fmt"
+	"os/exec"
+	"time"
+)
+
+const (
+	hostapdMinBackoff = time.Second
+	hostapdMaxBackoff = time.Minute
+	// hostapdStableAfter is how long hostapd must run before a crash is
+	// no longer counted as part of a crash loop.
+	hostapdStableAfter = 2 * time.Minute
+)
+
+// HostapdState describes the supervised hostapd process.
+type HostapdState struct {
+	Running  bool       `json:"running"`
+	Restarts int        `json:"restarts"`
+	LastExit string     `json:"last_exit,omitempty"`
+	ExitedAt *time.Time `json:"exited_at,omitempty"`
+}
+
+// hostapdExit reports a hostapd process exiting.
+type hostapdExit struct {
+	proc    *exec.Cmd
+	started time.Time
+	err     error
+}
+
+// waitHostapd reaps proc, reporting its exit to the supervisor. done is
+// closed once it has exited.
+func (c *Controller) waitHostapd(proc *exec.Cmd, done chan struct{}) {
+	started := time.Now()
+	err := proc.Wait()
+	close(done)
+	c.reportHostapdExit(hostapdExit{proc: proc, started: started, err: err})
+}
+
+func (c *Controller) reportHostapdExit(exit hostapdExit) {
+	select {
+	case c.hostapdExited <- exit:
+	case <-c.shutdown:
+	}
+}
+
+// failedHostapdStart stops hostapd after startHostapd fails, leaving it to
+// the supervisor to try again. If hostapd never started, there is no exit
+// for the supervisor to see, so one is reported for it. The caller must
+// hold setupLock.
+func (c *Controller) failedHostapdStart(err error) {
+	started := c.hostapdProc != nil
+	c.stopHostapd()
+	if !started {
+		go c.reportHostapdExit(hostapdExit{started: time.Now(), err: err})
+	}
+}
+
+// stopHostapd kills hostapd, and waits for it to exit. The caller must
+// hold setupLock, or be shutting down.
+func (c *Controller) stopHostapd() {
+	if c.hostapdProc == nil {
+		return
+	}
+	c.hostapdProc.Process.Kill()
+	<-c.hostapdDone
+	c.hostapdProc = nil
+	c.setHostapdRunning(false)
+}
+
+func (c *Controller) setHostapdRunning(running bool) {
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	c.hostapdState.Running = running
+}
+
+// HostapdState returns the state of the hostapd process.
+func (c *Controller) HostapdState() HostapdState {
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	return c.hostapdState
+}
+
+// hostapdSupervisorRoutine restarts hostapd when it exits unexpectedly,
+// backing off while it keeps crashing. The control clients reattach by
+// themselves once it is back.
+func (c *Controller) hostapdSupervisorRoutine() {
+	defer c.wg.Done()
+	backoff := hostapdMinBackoff
+
+	for {
+		var exit hostapdExit
+		select {
+		case <-c.shutdown:
+			return
+		case exit = <-c.hostapdExited:
+		}
+
+		c.setupLock.Lock()
+		if c.hostapdProc != nil && c.hostapdProc != exit.proc {
+			// Replaced on purpose, such as to change settings.
+			c.setupLock.Unlock()
+			continue
+		}
+		// Otherwise it crashed, or was stopped after failing to restart.
+		c.hostapdProc = nil
+		c.setupLock.Unlock()
+
+		reason := "exited"
+		if exit.err != nil {
+			reason = exit.err.Error()
+		}
+		fmt.Printf("hostapd stopped (%s), restarting\n", reason)
+		now := time.Now()
+		c.apLock.Lock()
+		c.hostapdState.Running = false
+		c.hostapdState.LastExit = reason
+		c.hostapdState.ExitedAt = &now
+		c.lastAPState = nil
+		c.lastStations = nil
+		c.apLock.Unlock()
+
+		if time.Since(exit.started) > hostapdStableAfter {
+			backoff = hostapdMinBackoff
+		}
+		for {
+			select {
+			case <-c.shutdown:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > hostapdMaxBackoff {
+				backoff = hostapdMaxBackoff
+			}
+
+			c.setupLock.Lock()
+			if c.hostapdProc != nil {
+				// Started while we were waiting.
+				c.setupLock.Unlock()
+				break
+			}
+			err := c.startHostapd()
+			if err != nil {
+				c.stopHostapd()
+			}
+			c.setupLock.Unlock()
+
+			if err == nil {
+				c.apLock.Lock()
+				c.hostapdState.Restarts++
+				c.apLock.Unlock()
+				break
+			}
+			fmt.Printf("Failed to restart hostapd: %v\n", err)
+		}
+	}
+}
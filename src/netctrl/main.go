@@ -17,6 +17,7 @@ import (
 
 	"github.com/coreos/go-iptables/iptables"
 	"github.com/krolaw/dhcp4"
+	"github.com/krolaw/dhcp4/conn"
 	"github.com/vishvananda/netlink"
 )
 
@@ -31,20 +32,68 @@ type Controller struct {
 	bridgeInterface *net.Interface
 	bridgeAddr      net.IP
 	subnet          *net.IPNet
-	areMasquerading bool
 	ipt             *iptables.IPTables
 
-	wlanAddr    net.IP
-	hostapdProc *exec.Cmd
-	lastAPState *hostapd.APStatus
+	wlanAddr net.IP
+	// hostapdProc is the running hostapd, if any, and hostapdDone is
+	// closed when it exits. Both are guarded by setupLock once the
+	// supervisor is running.
+	hostapdProc   *exec.Cmd
+	hostapdDone   chan struct{}
+	hostapdExited chan hostapdExit
+	// hostapdClients are connected to the control socket of each SSID,
+	// keyed by interface, and publish to hostapdEvents.
+	hostapdClients map[string]*hostapd.Client
+	hostapdEvents  chan hostapd.Event
+	// apLock guards lastAPState, lastStations and lastWPS, which are
+	// refreshed by the status routine, and when hostapd reports a change.
+	// It also guards the WPS timer, hostapdState and lastSurvey, and the
+	// wireless settings UpdateWireless and the survey change, for readers
+	// which do not hold setupLock.
+	apLock       sync.Mutex
+	hostapdState HostapdState
+	lastSurvey   *Survey
+	lastAPState  *hostapd.APStatus
+	lastStations []*hostapd.Station
+	lastWPS      *hostapd.WPSStatus
+	wpsTimer     *time.Timer
+	wpsExpires   time.Time
 
 	vpnProc      *exec.Cmd
 	vpnInterface *net.Interface
 	vpnAddr      net.IP
 	vpnConf      *config.VPNOpt
+	// vpnHook records the options pushed to the VPN, if it uses pushed
+	// DNS servers.
+	vpnHook *pushedOptionsHook
 
 	breakerUpdated time.Time
 	breakerTripped bool
+
+	state   *persistentState
+	captive *captivePortal
+	// uplink is nil unless an uplink interface is configured.
+	uplink *uplink
+
+	dnsUpstreams *upstreamPool
+	dnsForwarder *dnsForwarder
+	dnsCache     *dnsCache
+	dnsFilter    *dnsFilter
+	dnsRebind    *rebindProtection
+	dnsLocal     *localRecords
+	queryLog     *queryLog
+	dnsTimeout   time.Duration
+	// vpnDNS forwards to the DNS servers pushed by the active VPN, when
+	// it is configured to use them.
+	vpnDNSLock sync.RWMutex
+	vpnDNS     *upstreamPool
+
+	firewallRules []firewallRule
+
+	networks []*wirelessNetwork
+	// forwardingPinned is set when forwarding must stay enabled, as
+	// networks have their own VPNs.
+	forwardingPinned bool
 }
 
 // Close shuts down the VPN and hotspot
@@ -61,24 +110,37 @@ func (c *Controller) Close() error {
 			p.Kill()
 		}
 	}
+	c.closeVPNHook()
 
-	if c.hostapdProc != nil {
-		p, err := os.FindProcess(c.hostapdProc.Process.Pid)
-		if err != nil {
-			return err
-		}
-		if p.Signal(syscall.Signal(0)) == nil {
-			p.Kill()
-		}
+	c.closeHostapdClients()
+	return c.teardown()
+}
+
+// teardown undoes the setup done by NewController, as far as it got,
+// returning the first error.
+func (c *Controller) teardown() error {
+	c.stopHostapd()
+	c.closeUplink()
+	if c.queryLog != nil {
+		c.queryLog.Close()
 	}
 
-	if c.areMasquerading {
-		if err := c.ipt.Delete("nat", "POSTROUTING", "-m", "physdev", "--physdev-in", c.config.Network.Wireless.Interface, "-j", "MASQUERADE"); err != nil {
-			return err
+	var firstErr error
+	record := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
 		}
 	}
-
-	return DeleteNetBridge(c.bridgeInterface.Name)
+	if c.captive != nil {
+		record(c.captive.Close())
+		c.captive = nil
+	}
+	record(c.teardownFirewall())
+	record(c.closeNetworks())
+	if c.bridgeInterface != nil {
+		record(DeleteNetBridge(c.bridgeInterface.Name))
+	}
+	return firstErr
 }
 
 // SetVPN sets the network to tunnel all traffic through the VPN specified.
@@ -87,11 +149,7 @@ func (c *Controller) SetVPN(vpn *config.VPNOpt) error {
 	defer c.setupLock.Unlock()
 
 	// Prevent forwarding - so traffic is not routed outside the VPN.
-	if forwardingEnabled, err2 := IPv4ForwardingEnabled(); err2 == nil && forwardingEnabled {
-		if err3 := IPv4EnableForwarding(false); err3 != nil {
-			fmt.Printf("Error disabling IPv4 forwarding: %v\n", err3)
-		}
-	}
+	c.disableForwarding()
 
 	// kill any existing VPN process.
 	if c.vpnProc != nil {
@@ -104,6 +162,8 @@ func (c *Controller) SetVPN(vpn *config.VPNOpt) error {
 		}
 		c.vpnProc = nil
 		c.vpnInterface = nil
+		c.dnsForwarder.SetVPNRules(nil)
+		c.setVPNDNS(nil)
 
 		// wait for interface to disappear
 		timeout := time.NewTicker(5 * time.Second)
@@ -126,27 +186,47 @@ func (c *Controller) SetVPN(vpn *config.VPNOpt) error {
 		}
 	}
 
-	c.vpnConf = vpn
-	pw, err := ioutil.TempFile("", "")
+	// cached answers may have been geolocated for the previous VPN, and
+	// upstream connections were bound to the old tunnel.
+	c.dnsCache.Flush()
+	c.dnsUpstreams.CloseIdleConnections()
+	c.dnsForwarder.CloseIdleConnections()
+
+	rules, err := newForwardRules(vpn.DNSForwards, "tun"+c.config.Network.InterfaceIdent)
 	if err != nil {
 		return err
 	}
-	if _, err = pw.Write([]byte(vpn.Username + "\n" + vpn.Password)); err != nil {
-		return err
+	c.dnsForwarder.SetVPNRules(rules)
+
+	c.vpnConf = vpn
+	// The previous VPN has exited, or failed to start.
+	c.closeVPNHook()
+	var args []string
+	var hook *pushedOptionsHook
+	if vpn.UsePushedDNS {
+		if hook, err = newPushedOptionsHook(vpn); err != nil {
+			return err
+		}
+		c.vpnHook = hook
+		args = append(args, hook.Args()...)
 	}
-	if err = pw.Close(); err != nil {
+
+	var tun *net.Interface
+	if c.vpnProc, tun, err = startOpenVPN(vpn, "tun"+c.config.Network.InterfaceIdent, args...); err != nil {
 		return err
 	}
-	defer os.Remove(pw.Name())
+	c.vpnInterface = tun
 
-	c.vpnProc = exec.Command("openvpn", "--config", vpn.Path, "--dev", "tun"+c.config.Network.InterfaceIdent, "--auth-user-pass", pw.Name(), "--auth-nocache") //, "--route-noexec")
-	c.vpnProc.Stdout = os.Stdout
-	c.vpnProc.Stderr = os.Stderr
-	if err = c.vpnProc.Start(); err != nil {
+	// get local IP of VPN interface
+	addrs, err := c.vpnInterface.Addrs()
+	if err != nil {
 		return err
 	}
+	if len(addrs) < 1 {
+		return errors.New("expected at least one address assigned to VPN")
+	}
+	c.vpnAddr = addrs[0].(*net.IPNet).IP
 
-	// wait up to 11 seconds for VPN device to appear
 	timeout := time.NewTicker(11 * time.Second)
 	checker := time.NewTicker(50 * time.Millisecond)
 	defer timeout.Stop()
@@ -155,9 +235,11 @@ func (c *Controller) SetVPN(vpn *config.VPNOpt) error {
 		found := false
 		select {
 		case <-timeout.C:
-			return errors.New("timeout waiting for VPN to come up")
+			return errors.New("timeout waiting for VPN to routes up")
 		case <-checker.C:
-			if _, err2 := net.InterfaceByName("tun" + c.config.Network.InterfaceIdent); err2 == nil {
+			if rts, err := netlink.RouteGet(net.IP{8, 8, 8, 8}); err != nil || rts[0].LinkIndex != c.vpnInterface.Index {
+				fmt.Printf("Eval: %+v\n", rts)
+			} else {
 				found = true
 			}
 		}
@@ -166,37 +248,82 @@ func (c *Controller) SetVPN(vpn *config.VPNOpt) error {
 		}
 	}
 
-	// get local IP of VPN interface
-	if c.vpnInterface, err = net.InterfaceByName("tun" + c.config.Network.InterfaceIdent); err != nil {
-		return err
+	if hook != nil {
+		if err := c.usePushedDNS(vpn, hook); err != nil {
+			return err
+		}
 	}
-	addrs, err := c.vpnInterface.Addrs()
+
+	// The new tunnel is routing traffic, so the breaker can be reset.
+	c.breakerTripped = false
+	c.breakerUpdated = time.Now()
+	return IPv4EnableForwarding(true)
+}
+
+// closeVPNHook removes the up script of the previous VPN, which must have
+// exited.
+func (c *Controller) closeVPNHook() {
+	if c.vpnHook != nil {
+		c.vpnHook.Close()
+		c.vpnHook = nil
+	}
+}
+
+// startOpenVPN starts openvpn with the given configuration on the named tun
+// device, and waits up to 11 seconds for the device to appear.
+func startOpenVPN(vpn *config.VPNOpt, dev string, extraArgs ...string) (*exec.Cmd, *net.Interface, error) {
+	pw, err := ioutil.TempFile("", "")
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
-	if len(addrs) < 1 {
-		return errors.New("expected at least one address assigned to VPN")
+	defer os.Remove(pw.Name())
+	if _, err = pw.Write([]byte(vpn.Username + "\n" + vpn.Password)); err != nil {
+		pw.Close()
+		return nil, nil, err
+	}
+	if err = pw.Close(); err != nil {
+		return nil, nil, err
 	}
-	c.vpnAddr = addrs[0].(*net.IPNet).IP
 
+	args := append([]string{"--config", vpn.Path, "--dev", dev, "--auth-user-pass", pw.Name(), "--auth-nocache"}, extraArgs...)
+	cmd := exec.Command("openvpn", args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err = cmd.Start(); err != nil {
+		return nil, nil, err
+	}
+
+	timeout := time.NewTimer(11 * time.Second)
+	checker := time.NewTicker(50 * time.Millisecond)
+	defer timeout.Stop()
+	defer checker.Stop()
 	for {
-		found := false
 		select {
 		case <-timeout.C:
-			return errors.New("timeout waiting for VPN to routes up")
+			cmd.Process.Kill()
+			cmd.Wait()
+			return nil, nil, errors.New("timeout waiting for VPN to come up")
 		case <-checker.C:
-			if rts, err := netlink.RouteGet(net.IP{8, 8, 8, 8}); err != nil || rts[0].LinkIndex != c.vpnInterface.Index {
-				fmt.Printf("Eval: %+v\n", rts)
-			} else {
-				found = true
+			if tun, err := net.InterfaceByName(dev); err == nil {
+				return cmd, tun, nil
 			}
 		}
-		if found {
-			break
-		}
 	}
+}
 
-	return IPv4EnableForwarding(true)
+// disableForwarding stops traffic from clients being forwarded, such as
+// while the VPN is down. If any additional network has its own VPN,
+// forwarding must stay enabled for it, so the firewall instead pins every
+// network to its tunnel.
+func (c *Controller) disableForwarding() {
+	if c.forwardingPinned {
+		return
+	}
+	if forwardingEnabled, err := IPv4ForwardingEnabled(); err == nil && forwardingEnabled {
+		if err := IPv4EnableForwarding(false); err != nil {
+			fmt.Printf("Error disabling IPv4 forwarding: %v\n", err)
+		}
+	}
 }
 
 func (c *Controller) circuitBreakerRoutine() {
@@ -209,6 +336,7 @@ func (c *Controller) circuitBreakerRoutine() {
 		case <-c.shutdown:
 			return
 		case <-t.C:
+			c.refreshPushedDNS()
 			if c.vpnInterface != nil && !c.breakerTripped {
 				c.setupLock.Lock()
 				rts, err := netlink.RouteGet(net.IP{8, 8, 8, 8})
@@ -222,11 +350,7 @@ func (c *Controller) circuitBreakerRoutine() {
 					c.breakerUpdated = time.Now()
 					if c.breakerTripped {
 						fmt.Println("Tripped:", rts, c.vpnInterface)
-						if forwardingEnabled, err2 := IPv4ForwardingEnabled(); err2 == nil && forwardingEnabled {
-							if err3 := IPv4EnableForwarding(false); err3 != nil {
-								fmt.Printf("Error disabling IPv4 forwarding: %v\n", err3)
-							}
-						}
+						c.disableForwarding()
 					}
 				}
 				c.setupLock.Unlock()
@@ -237,47 +361,62 @@ func (c *Controller) circuitBreakerRoutine() {
 	}
 }
 
-func (c *Controller) dhcpDNSRoutine() {
-	laddr, _ := net.ResolveUDPAddr("udp", ":67")
-	listener, err := net.ListenUDP("udp", laddr)
-	if err != nil {
-		fmt.Printf("DHCP listen err: %v\n", err)
-		return
-	}
-	defer listener.Close()
-
-	var domainServers []byte
-	domainServers = append(domainServers, c.bridgeAddr.To4()...)
-	domainServers = append(domainServers, 8, 8, 8, 8)
-
+// newBridgeServices creates the DHCP and DNS services for a bridge. The
+// caller sets how DNS queries are forwarded upstream.
+func (c *Controller) newBridgeServices(bridgeAddr, serverAddr net.IP, subnet *net.IPNet) *bridgeServices {
 	options := dhcp4.Options{
-		dhcp4.OptionSubnetMask:             []byte{255, 255, 255, 0},
-		dhcp4.OptionRouter:                 c.bridgeAddr.To4(),
+		dhcp4.OptionSubnetMask:             []byte(net.IP(subnet.Mask).To4()),
+		dhcp4.OptionRouter:                 bridgeAddr.To4(),
 		dhcp4.OptionPerformRouterDiscovery: []byte{0},
-		dhcp4.OptionDomainNameServer:       domainServers,
+		// Only the local resolver, so clients cannot bypass the filters.
+		dhcp4.OptionDomainNameServer: bridgeAddr.To4(),
 	}
 
-	next := dhcp4.IPAdd(c.wlanAddr, 1)
-	handler := &bridgeServices{
-		name:    c.config.Name,
+	return &bridgeServices{
 		debug:   c.config.Debug.DHCP,
-		baseIP:  c.wlanAddr,
-		next:    next,
+		baseIP:  serverAddr,
+		next:    dhcp4.IPAdd(serverAddr, 1),
 		options: options,
 		leases:  map[string]net.IP{},
+
+		local:         c.dnsLocal,
+		filter:        c.dnsFilter,
+		blockResponse: c.config.DNS.BlockResponse,
+		rebind:        c.dnsRebind,
+		queryLog:      c.queryLog,
+		timeout:       c.dnsTimeout,
+		limiter:       newClientLimiter(c.config.DNS.MaxInflightPerClient),
+		portalIP:      bridgeAddr,
 	}
-	bcast := dhcp4.IPAdd(next, 0)
-	bcast[len(bcast)-1] = 255
-	if handler.debug {
-		fmt.Printf("DHCP broadcast address = %+v\nRouter address = %+v\n", bcast, c.bridgeAddr)
+}
+
+// serveBridgeServices serves DNS on the bridge address, and DHCP to clients
+// on the bridge, until the DHCP listener fails.
+func serveBridgeServices(h *bridgeServices, bridge *net.Interface, bridgeAddr net.IP, subnet *net.IPNet) {
+	listener, err := conn.NewUDP4BoundListener(bridge.Name, ":67")
+	if err != nil {
+		fmt.Printf("DHCP listen err: %v\n", err)
+		return
 	}
+	defer listener.Close()
 
-	if err = handler.setupUDPDNS(c.bridgeAddr.String()); err != nil {
+	bcast := make(net.IP, net.IPv4len)
+	for i, b := range subnet.IP.To4() {
+		bcast[i] = b | ^subnet.Mask[len(subnet.Mask)-net.IPv4len+i]
+	}
+	if h.debug {
+		fmt.Printf("DHCP broadcast address = %+v\nRouter address = %+v\n", bcast, bridgeAddr)
+	}
+
+	if err = h.setupUDPDNS(bridgeAddr.String()); err != nil {
 		fmt.Printf("DNS setup failed: %v\n", err)
 	}
+	if err = h.setupTCPDNS(bridgeAddr.String()); err != nil {
+		fmt.Printf("DNS TCP setup failed: %v\n", err)
+	}
 
 	for {
-		err := dhcp4.Serve(&dhcpLimitedBroadcastListener{conn: listener, bcastAddr: bcast}, handler)
+		err := dhcp4.Serve(&dhcpLimitedBroadcastListener{conn: listener, bcastAddr: bcast}, h)
 		if err, ok := err.(*net.OpError); ok && !err.Temporary() {
 			fmt.Printf("DHCP Serve() err: %v\n", err)
 			return
@@ -285,6 +424,16 @@ func (c *Controller) dhcpDNSRoutine() {
 	}
 }
 
+func (c *Controller) dhcpDNSRoutine() {
+	handler := c.newBridgeServices(c.bridgeAddr, c.wlanAddr, c.subnet)
+	handler.upstreams = c.defaultDNSUpstreams
+	handler.forwarder = c.dnsForwarder
+	handler.cache = c.dnsCache
+	handler.upstreamAllowed = c.dnsUpstreamAllowed
+	handler.captive = c.captive
+	serveBridgeServices(handler, c.bridgeInterface, c.bridgeAddr, c.subnet)
+}
+
 // startHostapd starts the hostapd process to manage the AP.
 func (c *Controller) startHostapd() error {
 	pw, err := ioutil.TempFile("", "")
@@ -308,12 +457,15 @@ func (c *Controller) startHostapd() error {
 	}
 	defer os.Remove(pw.Name())
 
-	c.hostapdProc = exec.Command("hostapd", "-dd", pw.Name())
-	c.hostapdProc.Stdout = os.Stdout
-	c.hostapdProc.Stderr = os.Stderr
-	if err := c.hostapdProc.Start(); err != nil {
+	proc := exec.Command("hostapd", "-dd", pw.Name())
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	if err := proc.Start(); err != nil {
 		return err
 	}
+	c.hostapdProc = proc
+	c.hostapdDone = make(chan struct{})
+	go c.waitHostapd(proc, c.hostapdDone)
 
 	// wait up to 8 seconds for Hostapd socket to start responding
 	timeout := time.NewTicker(8 * time.Second)
@@ -325,15 +477,9 @@ func (c *Controller) startHostapd() error {
 		select {
 		case <-timeout.C:
 			return errors.New("timeout waiting for hostapd to come up")
+		case <-c.hostapdDone:
+			return errors.New("hostapd has stopped")
 		case <-checker.C:
-			p, err := os.FindProcess(c.hostapdProc.Process.Pid)
-			if err != nil {
-				return err
-			}
-			if p.Signal(syscall.Signal(0)) != nil {
-				return errors.New("hostapd has stopped")
-			}
-
 			resp, err := hostapd.Query("/var/run/hostapd/"+c.config.Network.Wireless.Interface, "STATUS")
 			if err != nil {
 				continue
@@ -347,10 +493,7 @@ func (c *Controller) startHostapd() error {
 		}
 	}
 
-	if err := c.ipt.AppendUnique("nat", "POSTROUTING", "-m", "physdev", "--physdev-in", c.config.Network.Wireless.Interface, "-j", "MASQUERADE"); err != nil {
-		return err
-	}
-	c.areMasquerading = true
+	c.setHostapdRunning(true)
 	return nil
 }
 
@@ -364,37 +507,217 @@ func (c *Controller) hostapdStatusRoutine() {
 		case <-c.shutdown:
 			return
 		case <-t.C:
-			if c.hostapdProc != nil {
-				c.setupLock.Lock()
-				resp, err := hostapd.QueryStatus("/var/run/hostapd/" + c.config.Network.Wireless.Interface)
-				if err != nil {
-					c.setupLock.Unlock()
-					continue
-				}
-				c.lastAPState = resp
-				c.setupLock.Unlock()
+			if c.HostapdState().Running {
+				c.refreshAPStatus()
+				c.refreshStations()
 			}
 		}
 	}
 }
 
+// firewallRule is an iptables rule installed by the controller.
+type firewallRule struct {
+	table, chain string
+	spec         []string
+}
+
+// hostapdInterfaces returns the interfaces hostapd has a control socket
+// for: the wireless interface, and one for each additional network.
+func (c *Controller) hostapdInterfaces() []string {
+	if c.config.Network.Wireless.Interface == "" {
+		return nil
+	}
+	out := []string{c.config.Network.Wireless.Interface}
+	for i := range c.config.Network.Wireless.Networks {
+		out = append(out, config.NetworkInterfaceName(c.config, i))
+	}
+	return out
+}
+
+// refreshAPStatus updates the status of the access point.
+func (c *Controller) refreshAPStatus() {
+	resp, err := c.hostapdClients[c.config.Network.Wireless.Interface].Status()
+	if err != nil {
+		return
+	}
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	c.lastAPState = resp
+}
+
+// refreshStations updates the list of associated stations.
+func (c *Controller) refreshStations() {
+	var stations []*hostapd.Station
+	for _, iface := range c.hostapdInterfaces() {
+		s, err := c.hostapdClients[iface].Stations()
+		if err != nil {
+			fmt.Printf("Failed to query stations on %s: %v\n", iface, err)
+			return
+		}
+		for _, sta := range s {
+			sta.Interface = iface
+		}
+		stations = append(stations, s...)
+	}
+
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	c.lastStations = stations
+}
+
+// Stations returns the stations associated with the access point, as of
+// the last refresh.
+func (c *Controller) Stations() []*hostapd.Station {
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	if c.lastStations == nil {
+		return []*hostapd.Station{}
+	}
+	return c.lastStations
+}
+
+// appendRule appends a firewall rule, recording it so it is removed when
+// the controller shuts down.
+func (c *Controller) appendRule(table, chain string, spec ...string) error {
+	exists, err := c.ipt.Exists(table, chain, spec...)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+	if err := c.ipt.Append(table, chain, spec...); err != nil {
+		return err
+	}
+	c.firewallRules = append(c.firewallRules, firewallRule{table: table, chain: chain, spec: spec})
+	return nil
+}
+
 func (c *Controller) setupFirewall() error {
+	// Matching the subnet covers both wireless and wired clients.
+	if err := c.appendRule("nat", "POSTROUTING", "-s", c.config.Network.Subnet, "!", "-o", c.bridgeInterface.Name, "-j", "MASQUERADE"); err != nil {
+		return err
+	}
 	for _, port := range c.config.Firewall.VPNBoxBlockedPorts {
-		if err := c.ipt.AppendUnique("filter", "INPUT", "-s", c.config.Network.Subnet, "-p", "tcp", "--destination-port", strconv.Itoa(port), "-j", "DROP"); err != nil {
+		if err := c.appendRule("filter", "INPUT", "-s", c.config.Network.Subnet, "-p", "tcp", "--destination-port", strconv.Itoa(port), "-j", "DROP"); err != nil {
 			return err
 		}
-		if err := c.ipt.AppendUnique("filter", "INPUT", "-s", c.config.Network.Subnet, "-p", "udp", "--destination-port", strconv.Itoa(port), "-j", "DROP"); err != nil {
+		if err := c.appendRule("filter", "INPUT", "-s", c.config.Network.Subnet, "-p", "udp", "--destination-port", strconv.Itoa(port), "-j", "DROP"); err != nil {
 			return err
 		}
 	}
 	for _, subnet := range c.config.Firewall.BlockedSubnets {
-		if err := c.ipt.AppendUnique("filter", "FORWARD", "-s", c.config.Network.Subnet, "-d", subnet, "-j", "DROP"); err != nil {
+		if err := c.appendRule("filter", "FORWARD", "-s", c.config.Network.Subnet, "-d", subnet, "-j", "DROP"); err != nil {
+			return err
+		}
+	}
+	if c.config.Firewall.ForceDNS {
+		return c.setupDNSEnforcement(c.bridgeInterface, c.bridgeAddr)
+	}
+	return nil
+}
+
+// setupDNSEnforcement redirects all plain DNS from clients on the bridge to
+// the local resolver at addr, and blocks encrypted DNS which would bypass it.
+func (c *Controller) setupDNSEnforcement(bridgeInterface *net.Interface, addr net.IP) error {
+	bridge := bridgeInterface.Name
+	for _, proto := range []string{"udp", "tcp"} {
+		if err := c.appendRule("nat", "PREROUTING", "-i", bridge, "-p", proto, "--dport", "53", "-j", "DNAT", "--to-destination", addr.String()+":53"); err != nil {
+			return err
+		}
+		// DNS-over-TLS, and DNS-over-QUIC.
+		if err := c.appendRule("filter", "FORWARD", "-i", bridge, "-p", proto, "--dport", "853", "-j", "REJECT"); err != nil {
+			return err
+		}
+	}
+
+	endpoints, err := c.dohEndpoints()
+	if err != nil {
+		return err
+	}
+	for _, ip := range endpoints {
+		if err := c.appendRule("filter", "FORWARD", "-i", bridge, "-d", ip, "-p", "tcp", "--dport", "443", "-j", "REJECT"); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// dohEndpoints returns the addresses of public DNS-over-HTTPS servers
+// clients should be blocked from reaching.
+func (c *Controller) dohEndpoints() ([]string, error) {
+	out := append([]string(nil), c.config.Firewall.DOHBlockIPs...)
+	if c.config.Firewall.DOHBlockFile == "" {
+		return out, nil
+	}
+
+	d, err := ioutil.ReadFile(c.config.Firewall.DOHBlockFile)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(d), "\n") {
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		if line = strings.TrimSpace(line); line == "" {
+			continue
+		}
+		if net.ParseIP(line) == nil {
+			if _, _, err := net.ParseCIDR(line); err != nil {
+				return nil, fmt.Errorf("%s: invalid address %q", c.config.Firewall.DOHBlockFile, line)
+			}
+		}
+		out = append(out, line)
+	}
+	return out, nil
+}
+
+// teardownFirewall removes the rules installed by setupFirewall.
+func (c *Controller) teardownFirewall() error {
+	var firstErr error
+	for i := len(c.firewallRules) - 1; i >= 0; i-- {
+		r := c.firewallRules[i]
+		if err := c.ipt.Delete(r.table, r.chain, r.spec...); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.firewallRules = nil
+	return firstErr
+}
+
+func (c *Controller) setupCaptivePortal() error {
+	duration, err := time.ParseDuration(c.config.CaptivePortal.ApprovalDuration)
+	if err != nil {
+		return err
+	}
+	_, port, err := net.SplitHostPort(c.config.Listener)
+	if err != nil {
+		return err
+	}
+	c.captive, err = newCaptivePortal(c.ipt, c.state, c.bridgeInterface, c.bridgeAddr, port, duration)
+	return err
+}
+
+// dnsUpstreamAllowed returns true if DNS queries may be forwarded upstream.
+// Unless configured otherwise, this is only when the VPN is up and the
+// circuit breaker has not tripped.
+func (c *Controller) dnsUpstreamAllowed() bool {
+	if c.config.DNS.AllowUplink {
+		return true
+	}
+	return c.vpnInterface != nil && !c.breakerTripped
+}
+
+// DNSCacheStats returns statistics about the DNS cache.
+func (c *Controller) DNSCacheStats() DNSCacheStats {
+	return c.dnsCache.Stats()
+}
+
+// FlushDNSCache removes all cached DNS responses.
+func (c *Controller) FlushDNSCache() {
+	c.dnsCache.Flush()
+}
+
 // NewController creates and starts a controller.
 func NewController(c *config.Config) (*Controller, error) {
 	ipt, err := iptables.New()
@@ -402,42 +725,136 @@ func NewController(c *config.Config) (*Controller, error) {
 		return nil, err
 	}
 
+	state, err := loadPersistentState(c.StatePath)
+	if err != nil {
+		return nil, err
+	}
+
 	ctr := &Controller{
 		shutdown: make(chan bool),
 		config:   c,
 		ipt:      ipt,
+		state:    state,
+	}
+	bindDevice := "tun" + c.Network.InterfaceIdent
+	if c.DNS.AllowUplink {
+		bindDevice = ""
+	}
+	if ctr.dnsUpstreams, err = newUpstreamPool(c.DNS.Upstreams, bindDevice); err != nil {
+		return nil, err
+	}
+	ctr.dnsForwarder = &dnsForwarder{}
+	if ctr.dnsForwarder.global, err = newForwardRules(c.DNS.Forwards, bindDevice); err != nil {
+		return nil, err
+	}
+	if ctr.dnsTimeout, err = time.ParseDuration(c.DNS.UpstreamTimeout); err != nil {
+		return nil, err
+	}
+	ctr.dnsCache = newDNSCache(c.DNS.CacheSize)
+	ctr.dnsFilter = newDNSFilter(c)
+	if c.DNS.RebindProtection.Enabled {
+		ctr.dnsRebind = newRebindProtection(c)
+	}
+	if c.DNS.QueryLog.Enabled {
+		if ctr.queryLog, err = newQueryLog(c); err != nil {
+			return nil, err
+		}
 	}
 	ctr.bridgeAddr, ctr.subnet, err = net.ParseCIDR(c.Network.Subnet)
 	if err != nil {
+		ctr.teardown()
 		return nil, err
 	}
 	ctr.bridgeInterface, err = CreateNetBridge("br"+c.Network.InterfaceIdent, ctr.bridgeAddr, &net.IPNet{Mask: ctr.subnet.Mask})
 	if err != nil {
+		ctr.teardown()
 		return nil, err
 	}
 
 	ctr.wlanAddr = dhcp4.IPAdd(ctr.bridgeAddr, 1)
-	if c.Network.Wireless.Interface != "" {
-		if err := SetInterfaceAddr(c.Network.Wireless.Interface, &net.IPNet{IP: ctr.wlanAddr, Mask: ctr.subnet.Mask}); err != nil {
-			DeleteNetBridge(ctr.bridgeInterface.Name)
-			return nil, err
-		}
+	if ctr.dnsLocal, err = newLocalRecords(c, ctr.wlanAddr); err != nil {
+		ctr.teardown()
+		return nil, err
+	}
+	// DHCP and the router's DNS name use wlanAddr, so it must be assigned
+	// even without a wireless interface.
+	addrInterface := c.Network.Wireless.Interface
+	if addrInterface == "" {
+		addrInterface = ctr.bridgeInterface.Name
+	}
+	if err := SetInterfaceAddr(addrInterface, &net.IPNet{IP: ctr.wlanAddr, Mask: ctr.subnet.Mask}); err != nil {
+		ctr.teardown()
+		return nil, err
 	}
 
-	if err := ctr.setupFirewall(); err != nil {
-		DeleteNetBridge(ctr.bridgeInterface.Name)
+	if err := ctr.attachWiredInterfaces(); err != nil {
+		ctr.teardown()
 		return nil, err
 	}
 
-	if err := ctr.startHostapd(); err != nil {
-		DeleteNetBridge(ctr.bridgeInterface.Name)
+	if err := ctr.setupNetworks(); err != nil {
+		ctr.teardown()
+		return nil, err
+	}
+	if err := ctr.setupAllFirewalls(); err != nil {
+		ctr.teardown()
 		return nil, err
 	}
 
+	if c.CaptivePortal.Enabled {
+		if err := ctr.setupCaptivePortal(); err != nil {
+			ctr.teardown()
+			return nil, err
+		}
+	}
+
+	if c.Network.Uplink.Interface != "" {
+		if err := ctr.startUplink(); err != nil {
+			ctr.teardown()
+			return nil, err
+		}
+	}
+
+	// Without a wireless interface, only wired clients are served.
+	if c.Network.Wireless.Interface != "" {
+		if c.Network.Wireless.ChannelSurvey {
+			ctr.surveyChannel(true)
+		}
+		ctr.hostapdExited = make(chan hostapdExit, 1)
+		if err := ctr.startHostapd(); err != nil {
+			ctr.teardown()
+			return nil, err
+		}
+
+		ctr.startHostapdClients()
+		ctr.wg.Add(1)
+		go ctr.hostapdEventRoutine()
+		ctr.wg.Add(1)
+		go ctr.hostapdStatusRoutine()
+		ctr.wg.Add(1)
+		go ctr.hostapdSupervisorRoutine()
+		if c.Network.Wireless.SurveyQuietHours != "" {
+			ctr.wg.Add(1)
+			go ctr.surveyRoutine()
+		}
+	}
 	ctr.wg.Add(1)
 	go ctr.circuitBreakerRoutine()
 	ctr.wg.Add(1)
-	go ctr.hostapdStatusRoutine()
+	go ctr.dnsFilterRoutine()
+	if ctr.captive != nil {
+		ctr.wg.Add(1)
+		go ctr.captiveRoutine()
+	}
 	go ctr.dhcpDNSRoutine()
+	ctr.startNetworks()
+	if ctr.uplink != nil {
+		ctr.wg.Add(1)
+		go ctr.uplinkRoutine()
+		ctr.wg.Add(1)
+		go ctr.uplinkVPNRoutine()
+		// The VPN is set up once this returns, and needs the uplink.
+		ctr.waitUplinkLease()
+	}
 	return ctr, nil
 }
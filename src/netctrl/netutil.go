@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net"
+	"syscall"
 
 	"github.com/vishvananda/netlink"
 )
@@ -12,6 +13,9 @@ import (
 // ErrDeviceExists indicates a device with that name already exists.
 var ErrDeviceExists = errors.New("interface with that name already exists")
 
+// ErrNoNeighbour indicates no neighbour with that address is known.
+var ErrNoNeighbour = errors.New("no neighbour with that address")
+
 // CreateNetBridge creates a new bridge device with the specified name and IP configuration.
 // if a device with devName already exists, ErrDeviceExists is returned.
 func CreateNetBridge(devName string, ip net.IP, subnet *net.IPNet) (*net.Interface, error) {
@@ -53,6 +57,37 @@ func AttachNetBridge(bridge, client *net.Interface) error {
 	return netlink.LinkSetMaster(clientLink, bridgeLink.(*netlink.Bridge))
 }
 
+// HardwareAddrByIP returns the MAC address of the neighbour with the given IP,
+// as learned by the kernel on the given interface.
+func HardwareAddrByIP(iface *net.Interface, ip net.IP) (net.HardwareAddr, error) {
+	neighs, err := netlink.NeighList(iface.Index, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range neighs {
+		if n.IP.Equal(ip) && len(n.HardwareAddr) > 0 {
+			return n.HardwareAddr, nil
+		}
+	}
+	return nil, ErrNoNeighbour
+}
+
+// BindToDevice returns a net.Dialer control function which binds sockets to
+// the named interface (SO_BINDTODEVICE), so their traffic cannot leave via
+// any other interface.
+func BindToDevice(devName string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var opErr error
+		err := c.Control(func(fd uintptr) {
+			opErr = syscall.SetsockoptString(int(fd), syscall.SOL_SOCKET, syscall.SO_BINDTODEVICE, devName)
+		})
+		if err != nil {
+			return err
+		}
+		return opErr
+	}
+}
+
 // RouteAddViaGatewayFromAddr adds a new route to the given IP network,
 // routed by the given gateway when it comes from the given source.
 // This is equivalent to 'ip route add <destination> via <gateway>'.
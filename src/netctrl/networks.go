@@ -0,0 +1,408 @@
+package netctrl
+
+import (
+	"config"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	// networkTableBase and networkRulePriority number the routing tables
+	// and policy rules which send a network's traffic through its VPN.
+	networkTableBase    = 100
+	networkRulePriority = 1000
+	// networkUnreachableMetric is the metric of the unreachable default
+	// route in each network's table, which the tunnel's default route takes
+	// precedence over while it is up.
+	networkUnreachableMetric = 4096
+	// networkVPNRetry is how long to wait before restarting a network's
+	// VPN after it fails.
+	networkVPNRetry = 10 * time.Second
+)
+
+// NetworkState describes an additional wireless network.
+type NetworkState struct {
+	Name   string `json:"name"`
+	SSID   string `json:"SSID"`
+	Subnet string `json:"subnet"`
+	VPN    struct {
+		Name      string `json:"name,omitempty"`
+		Connected bool   `json:"connected"`
+		LastError string `json:"last_error,omitempty"`
+	} `json:"vpn"`
+}
+
+// wirelessNetwork is an additional SSID, with its own bridge, subnet and
+// DHCP and DNS services. It may be tunnelled through its own VPN, in which
+// case its traffic is routed by policy rules, and cannot leave any other
+// way: its table holds an unreachable default route while the tunnel is
+// down.
+type wirelessNetwork struct {
+	conf            *config.WirelessNetwork
+	index           int
+	bridgeInterface *net.Interface
+	bridgeAddr      net.IP
+	subnet          *net.IPNet
+
+	// The remaining fields are only set if the network has its own VPN.
+	vpn        *config.VPNOpt
+	tunnelName string
+	upstreams  *upstreamPool
+	forwarder  *dnsForwarder
+	cache      *dnsCache
+
+	lock    sync.Mutex
+	vpnProc *exec.Cmd
+	tunnel  *net.Interface
+	lastErr error
+}
+
+func newWirelessNetwork(c *config.Config, index int) (*wirelessNetwork, error) {
+	n := &wirelessNetwork{conf: &c.Network.Wireless.Networks[index], index: index}
+	var err error
+	if n.bridgeAddr, n.subnet, err = net.ParseCIDR(n.conf.Subnet); err != nil {
+		return nil, err
+	}
+
+	if n.conf.VPN != "" {
+		for i := range c.VPNConfigurations {
+			if c.VPNConfigurations[i].Name == n.conf.VPN {
+				n.vpn = &c.VPNConfigurations[i]
+			}
+		}
+		if n.vpn == nil {
+			return nil, fmt.Errorf("no VPN configuration named %q", n.conf.VPN)
+		}
+		n.tunnelName = config.NetworkTunnelName(c, index)
+
+		bindDevice := n.tunnelName
+		if c.DNS.AllowUplink {
+			bindDevice = ""
+		}
+		if n.upstreams, err = newUpstreamPool(c.DNS.Upstreams, bindDevice); err != nil {
+			return nil, err
+		}
+		n.forwarder = &dnsForwarder{}
+		if n.forwarder.global, err = newForwardRules(c.DNS.Forwards, bindDevice); err != nil {
+			return nil, err
+		}
+		if n.forwarder.vpn, err = newForwardRules(n.vpn.DNSForwards, n.tunnelName); err != nil {
+			return nil, err
+		}
+		n.cache = newDNSCache(c.DNS.CacheSize)
+	}
+
+	n.bridgeInterface, err = CreateNetBridge(config.NetworkBridgeName(c, index), n.bridgeAddr, &net.IPNet{Mask: n.subnet.Mask})
+	if err != nil {
+		return nil, err
+	}
+	if n.vpn != nil {
+		if err := n.setupRouting(); err != nil {
+			n.Close()
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// routes returns the routes in the network's table, other than the default
+// route through the tunnel. The table also matches rnd's own replies to
+// clients, from the bridge address, which must stay on the bridge.
+func (n *wirelessNetwork) routes() []*netlink.Route {
+	table := networkTableBase + n.index
+	return []*netlink.Route{
+		{LinkIndex: n.bridgeInterface.Index, Dst: n.subnet, Src: n.bridgeAddr, Table: table, Scope: netlink.SCOPE_LINK},
+		{Table: table, Type: syscall.RTN_UNREACHABLE, Priority: networkUnreachableMetric},
+	}
+}
+
+// tunnelRoute returns the default route through the network's tunnel.
+func (n *wirelessNetwork) tunnelRoute(tun *net.Interface) *netlink.Route {
+	return &netlink.Route{LinkIndex: tun.Index, Table: networkTableBase + n.index, Scope: netlink.SCOPE_LINK}
+}
+
+// setupRouting installs the network's table and policy rule. They stay in
+// place while the VPN restarts, so its traffic is dropped rather than sent
+// another way.
+func (n *wirelessNetwork) setupRouting() error {
+	for _, route := range n.routes() {
+		if err := netlink.RouteReplace(route); err != nil {
+			return err
+		}
+	}
+	rule := n.rule()
+	netlink.RuleDel(rule)
+	return netlink.RuleAdd(rule)
+}
+
+// removeRouting removes the network's policy rule and table.
+func (n *wirelessNetwork) removeRouting() {
+	netlink.RuleDel(n.rule())
+	for _, route := range n.routes() {
+		netlink.RouteDel(route)
+	}
+}
+
+// tunnelUp returns true if the network's VPN is connected.
+func (n *wirelessNetwork) tunnelUp() bool {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.tunnel != nil
+}
+
+// startVPN starts the network's VPN, and routes the network's traffic
+// through it.
+func (n *wirelessNetwork) startVPN() error {
+	// Routes are managed here, rather than by openvpn, as they must only
+	// apply to this network.
+	proc, tun, err := startOpenVPN(n.vpn, n.tunnelName, "--route-noexec")
+	if err != nil {
+		return err
+	}
+
+	if err := netlink.RouteReplace(n.tunnelRoute(tun)); err != nil {
+		proc.Process.Kill()
+		proc.Wait()
+		return err
+	}
+
+	n.upstreams.CloseIdleConnections()
+	n.forwarder.CloseIdleConnections()
+	n.cache.Flush()
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	n.vpnProc, n.tunnel, n.lastErr = proc, tun, nil
+	return nil
+}
+
+// rule returns the policy rule which routes the network's traffic using its
+// own table.
+func (n *wirelessNetwork) rule() *netlink.Rule {
+	rule := netlink.NewRule()
+	rule.Src = n.subnet
+	rule.Table = networkTableBase + n.index
+	rule.Priority = networkRulePriority + n.index
+	return rule
+}
+
+// stopVPN stops the network's VPN, if it is running, and removes the route
+// through its tunnel.
+func (n *wirelessNetwork) stopVPN() {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	if n.vpnProc != nil {
+		n.vpnProc.Process.Kill()
+		n.vpnProc = nil
+	}
+	if n.tunnel != nil {
+		// The route usually goes with the tunnel, once openvpn exits.
+		netlink.RouteDel(n.tunnelRoute(n.tunnel))
+		n.tunnel = nil
+	}
+}
+
+// Close stops the network's VPN, and removes its routing and bridge.
+func (n *wirelessNetwork) Close() error {
+	if n.vpn != nil {
+		n.stopVPN()
+		n.removeRouting()
+	}
+	return DeleteNetBridge(n.bridgeInterface.Name)
+}
+
+// State returns the status of the network.
+func (n *wirelessNetwork) State() NetworkState {
+	out := NetworkState{Name: n.conf.Name, SSID: n.conf.SSID, Subnet: n.subnet.String()}
+	if n.vpn == nil {
+		return out
+	}
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	out.VPN.Name = n.vpn.Name
+	out.VPN.Connected = n.tunnel != nil
+	if n.lastErr != nil {
+		out.VPN.LastError = n.lastErr.Error()
+	}
+	return out
+}
+
+// setupNetworks creates the bridges for additional networks.
+func (c *Controller) setupNetworks() error {
+	for i := range c.config.Network.Wireless.Networks {
+		n, err := newWirelessNetwork(c.config, i)
+		if err != nil {
+			return fmt.Errorf("network %q: %v", c.config.Network.Wireless.Networks[i].Name, err)
+		}
+		c.networks = append(c.networks, n)
+		if n.vpn != nil {
+			c.forwardingPinned = true
+		}
+	}
+	return nil
+}
+
+// setupNetworkFirewall isolates the networks from each other, applies each
+// network's policy, and if any network has its own VPN, pins each network
+// to its tunnel.
+func (c *Controller) setupNetworkFirewall() error {
+	bridges := []string{c.bridgeInterface.Name}
+	for _, n := range c.networks {
+		bridges = append(bridges, n.bridgeInterface.Name)
+	}
+	for _, from := range bridges {
+		for _, to := range bridges {
+			if from != to {
+				if err := c.appendRule("filter", "FORWARD", "-i", from, "-o", to, "-j", "DROP"); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	mainTunnel := "tun" + c.config.Network.InterfaceIdent
+	if c.forwardingPinned {
+		if err := c.appendRule("filter", "FORWARD", "-i", c.bridgeInterface.Name, "!", "-o", mainTunnel, "-j", "DROP"); err != nil {
+			return err
+		}
+	}
+
+	for _, n := range c.networks {
+		bridge, subnet := n.bridgeInterface.Name, n.subnet.String()
+		for _, port := range n.conf.BlockedPorts {
+			for _, proto := range []string{"tcp", "udp"} {
+				if err := c.appendRule("filter", "INPUT", "-s", subnet, "-p", proto, "--destination-port", strconv.Itoa(port), "-j", "DROP"); err != nil {
+					return err
+				}
+			}
+		}
+		for _, dest := range n.conf.BlockedSubnets {
+			if err := c.appendRule("filter", "FORWARD", "-s", subnet, "-d", dest, "-j", "DROP"); err != nil {
+				return err
+			}
+		}
+
+		tunnel := n.tunnelName
+		if tunnel == "" {
+			tunnel = mainTunnel
+		}
+		if c.forwardingPinned {
+			if err := c.appendRule("filter", "FORWARD", "-i", bridge, "!", "-o", tunnel, "-j", "DROP"); err != nil {
+				return err
+			}
+		}
+		if err := c.appendRule("nat", "POSTROUTING", "-s", subnet, "!", "-o", bridge, "-j", "MASQUERADE"); err != nil {
+			return err
+		}
+		if c.config.Firewall.ForceDNS {
+			if err := c.setupDNSEnforcement(n.bridgeInterface, n.bridgeAddr); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// startNetworks starts the services for each additional network.
+func (c *Controller) startNetworks() {
+	for _, n := range c.networks {
+		h := c.newBridgeServices(n.bridgeAddr, n.bridgeAddr, n.subnet)
+		if n.vpn != nil {
+			n := n
+			pool := n.upstreams
+			h.upstreams = func() *upstreamPool { return pool }
+			h.forwarder = n.forwarder
+			h.cache = n.cache
+			h.upstreamAllowed = func() bool { return c.config.DNS.AllowUplink || n.tunnelUp() }
+
+			c.wg.Add(1)
+			go c.networkVPNRoutine(n)
+		} else {
+			h.upstreams = c.defaultDNSUpstreams
+			h.forwarder = c.dnsForwarder
+			h.cache = c.dnsCache
+			h.upstreamAllowed = c.dnsUpstreamAllowed
+		}
+		go serveBridgeServices(h, n.bridgeInterface, n.bridgeAddr, n.subnet)
+	}
+}
+
+// networkVPNRoutine keeps a network's VPN running, restarting it if it
+// fails.
+func (c *Controller) networkVPNRoutine(n *wirelessNetwork) {
+	defer c.wg.Done()
+	for {
+		err := n.startVPN()
+		if err == nil {
+			n.lock.Lock()
+			proc := n.vpnProc
+			n.lock.Unlock()
+			exited := make(chan error, 1)
+			go func() { exited <- proc.Wait() }()
+			select {
+			case <-c.shutdown:
+				return
+			case err = <-exited:
+				if err == nil {
+					err = errors.New("VPN exited")
+				}
+			}
+		}
+		fmt.Printf("VPN for network %q failed: %v\n", n.conf.Name, err)
+		n.stopVPN()
+		n.lock.Lock()
+		n.lastErr = err
+		n.lock.Unlock()
+
+		select {
+		case <-c.shutdown:
+			return
+		case <-time.After(networkVPNRetry):
+		}
+	}
+}
+
+// NetworkStates returns the status of each additional network.
+func (c *Controller) NetworkStates() []NetworkState {
+	out := make([]NetworkState, len(c.networks))
+	for i, n := range c.networks {
+		out[i] = n.State()
+	}
+	return out
+}
+
+// setupAllFirewalls sets up the firewall for the primary network and any
+// additional ones. Forwarding is enabled up front if it is pinned, as it is
+// then never disabled.
+func (c *Controller) setupAllFirewalls() error {
+	if err := c.setupFirewall(); err != nil {
+		return err
+	}
+	if err := c.setupNetworkFirewall(); err != nil {
+		return err
+	}
+	if c.forwardingPinned {
+		return IPv4EnableForwarding(true)
+	}
+	return nil
+}
+
+// closeNetworks stops and removes any additional networks.
+func (c *Controller) closeNetworks() error {
+	var firstErr error
+	for _, n := range c.networks {
+		if err := n.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.networks = nil
+	return firstErr
+}
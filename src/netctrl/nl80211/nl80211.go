@@ -0,0 +1,137 @@
+package nl80211
+
+import (
+	"errors"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Commands and attributes, from linux/nl80211.h.
+const (
+	cmdGetWiphy       = 1
+	cmdReqSetReg      = 27
+	cmdGetScan        = 32
+	cmdTriggerScan    = 33
+	cmdNewScanResults = 34
+	cmdScanAborted    = 35
+
+	attrIfindex        = 3
+	attrWiphyBands     = 22
+	attrRegAlpha2      = 33
+	attrBSS            = 47
+	attrSplitWiphyDump = 174
+
+	bandAttrFreqs = 1
+
+	freqAttrFreq     = 1
+	freqAttrDisabled = 2
+	freqAttrNoIR     = 3
+	freqAttrRadar    = 5
+
+	bssBSSID               = 1
+	bssFrequency           = 2
+	bssInformationElements = 6
+	bssSignalMBM           = 7
+)
+
+// family is the nl80211 generic netlink family.
+type family struct {
+	id        uint16
+	scanGroup uint32
+}
+
+func getFamily() (*family, error) {
+	f, err := netlink.GenlFamilyGet("nl80211")
+	if err != nil {
+		return nil, err
+	}
+	out := &family{id: f.ID}
+	for _, g := range f.Groups {
+		if g.Name == "scan" {
+			out.scanGroup = g.ID
+		}
+	}
+	return out, nil
+}
+
+// request sends a command, returning the replies with the generic netlink
+// header removed.
+func (f *family) request(cmd uint8, flags int, attrs ...*nl.RtAttr) ([][]byte, error) {
+	req := nl.NewNetlinkRequest(int(f.id), flags)
+	req.AddData(&nl.Genlmsg{Command: cmd, Version: 1})
+	for _, a := range attrs {
+		req.AddData(a)
+	}
+	msgs, err := req.Execute(unix.NETLINK_GENERIC, f.id)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, 0, len(msgs))
+	for _, m := range msgs {
+		if len(m) >= nl.SizeofGenlmsg {
+			out = append(out, m[nl.SizeofGenlmsg:])
+		}
+	}
+	return out, nil
+}
+
+// parseAttrs returns the attributes in b by type. Attributes which can
+// appear more than once should be parsed with nl.ParseRouteAttr.
+func parseAttrs(b []byte) (map[uint16][]byte, error) {
+	attrs, err := nl.ParseRouteAttr(b)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[uint16][]byte, len(attrs))
+	for _, a := range attrs {
+		out[a.Attr.Type&^(unix.NLA_F_NESTED|unix.NLA_F_NET_BYTEORDER)] = a.Value
+	}
+	return out, nil
+}
+
+func attrUint32(attrs map[uint16][]byte, t uint16) (uint32, bool) {
+	v, ok := attrs[t]
+	if !ok || len(v) < 4 {
+		return 0, false
+	}
+	return nl.NativeEndian().Uint32(v), true
+}
+
+func ifindexAttr(iface string) (*nl.RtAttr, error) {
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return nil, err
+	}
+	return nl.NewRtAttr(attrIfindex, nl.Uint32Attr(uint32(link.Index))), nil
+}
+
+// SetRegulatoryDomain asks the kernel to apply the rules for a country,
+// given as its ISO 3166-1 code. It takes effect asynchronously.
+func SetRegulatoryDomain(country string) error {
+	if len(country) != 2 {
+		return errors.New("country code must be two letters")
+	}
+	f, err := getFamily()
+	if err != nil {
+		return err
+	}
+	_, err = f.request(cmdReqSetReg, unix.NLM_F_ACK, nl.NewRtAttr(attrRegAlpha2, nl.ZeroTerminated(country)))
+	return err
+}
+
+// FrequencyChannel returns the channel number for a frequency in MHz, or 0
+// if it is not in the 2.4GHz or 5GHz bands.
+func FrequencyChannel(freq int) int {
+	switch {
+	case freq == 2484:
+		return 14
+	case freq >= 2412 && freq < 2484:
+		return (freq - 2407) / 5
+	case freq >= 5160 && freq <= 5885:
+		return (freq - 5000) / 5
+	}
+	return 0
+}
@@ -0,0 +1,154 @@
+package nl80211
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// BSS is a network found by a scan.
+type BSS struct {
+	BSSID string `json:"BSSID"`
+	// SSID is empty for hidden networks.
+	SSID      string `json:"SSID"`
+	Frequency int    `json:"frequency"` // MHz
+	Channel   int    `json:"channel"`
+	Signal    int    `json:"signal"` // dBm
+}
+
+// Scan asks the device behind iface to scan every channel, and returns the
+// networks it found. The interface must be up, and not running an AP.
+func Scan(iface string, timeout time.Duration) ([]BSS, error) {
+	f, err := getFamily()
+	if err != nil {
+		return nil, err
+	}
+	if f.scanGroup == 0 {
+		return nil, errors.New("nl80211 has no scan multicast group")
+	}
+	ifindex, err := ifindexAttr(iface)
+	if err != nil {
+		return nil, err
+	}
+
+	// Listen for the scan finishing before starting it, so the
+	// notification cannot be missed.
+	s, err := nl.Subscribe(unix.NETLINK_GENERIC)
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if err := unix.SetsockoptInt(s.GetFd(), unix.SOL_NETLINK, unix.NETLINK_ADD_MEMBERSHIP, int(f.scanGroup)); err != nil {
+		return nil, err
+	}
+
+	if _, err := f.request(cmdTriggerScan, unix.NLM_F_ACK, ifindex); err != nil {
+		return nil, fmt.Errorf("starting scan: %v", err)
+	}
+	if err := waitScan(s, f.id, nl.NativeEndian().Uint32(ifindex.Data), timeout); err != nil {
+		return nil, err
+	}
+
+	msgs, err := f.request(cmdGetScan, unix.NLM_F_DUMP, ifindex)
+	if err != nil {
+		return nil, fmt.Errorf("reading scan results: %v", err)
+	}
+	out := make([]BSS, 0, len(msgs))
+	for _, m := range msgs {
+		bss, err := parseBSS(m)
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, *bss)
+	}
+	return out, nil
+}
+
+// waitScan waits for the scan on ifindex to finish.
+func waitScan(s *nl.NetlinkSocket, familyID uint16, ifindex uint32, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return errors.New("timeout waiting for scan results")
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		if err := s.SetReceiveTimeout(&tv); err != nil {
+			return err
+		}
+		msgs, err := s.Receive()
+		if err == unix.EAGAIN || err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, m := range msgs {
+			if m.Header.Type != familyID || len(m.Data) < nl.SizeofGenlmsg {
+				continue
+			}
+			attrs, err := parseAttrs(m.Data[nl.SizeofGenlmsg:])
+			if err != nil {
+				continue
+			}
+			if idx, ok := attrUint32(attrs, attrIfindex); !ok || idx != ifindex {
+				continue
+			}
+			switch m.Data[0] {
+			case cmdNewScanResults:
+				return nil
+			case cmdScanAborted:
+				return errors.New("scan was aborted")
+			}
+		}
+	}
+}
+
+func parseBSS(msg []byte) (*BSS, error) {
+	attrs, err := parseAttrs(msg)
+	if err != nil {
+		return nil, err
+	}
+	b, ok := attrs[attrBSS]
+	if !ok {
+		return nil, errors.New("scan result without a BSS")
+	}
+	bss, err := parseAttrs(b)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &BSS{}
+	if v := bss[bssBSSID]; len(v) == 6 {
+		out.BSSID = net.HardwareAddr(v).String()
+	}
+	if freq, ok := attrUint32(bss, bssFrequency); ok {
+		out.Frequency = int(freq)
+		out.Channel = FrequencyChannel(out.Frequency)
+	}
+	if mbm, ok := attrUint32(bss, bssSignalMBM); ok {
+		out.Signal = int(int32(mbm)) / 100
+	}
+	out.SSID = ieSSID(bss[bssInformationElements])
+	return out, nil
+}
+
+// ieSSID returns the SSID from a BSS's information elements.
+func ieSSID(ies []byte) string {
+	for len(ies) >= 2 {
+		id, n := ies[0], int(ies[1])
+		if len(ies) < 2+n {
+			break
+		}
+		if id == 0 {
+			return string(ies[2 : 2+n])
+		}
+		ies = ies[2+n:]
+	}
+	return ""
+}
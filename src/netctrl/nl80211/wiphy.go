@@ -0,0 +1,88 @@
+package nl80211
+
+import (
+	"sort"
+
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// Channel is a channel supported by a wireless device.
+type Channel struct {
+	Frequency int `json:"frequency"` // MHz
+	Channel   int `json:"channel"`
+	// Disabled channels cannot be used in the current regulatory domain.
+	Disabled bool `json:"disabled,omitempty"`
+	// NoIR channels cannot be used to start a network.
+	NoIR bool `json:"no_ir,omitempty"`
+	// Radar channels need DFS, which delays starting the AP.
+	Radar bool `json:"radar,omitempty"`
+}
+
+// Channels returns the channels supported by the device behind iface, as
+// restricted by the current regulatory domain.
+func Channels(iface string) ([]Channel, error) {
+	f, err := getFamily()
+	if err != nil {
+		return nil, err
+	}
+	ifindex, err := ifindexAttr(iface)
+	if err != nil {
+		return nil, err
+	}
+	// Devices are described over several messages, as some are too big
+	// to fit in one.
+	msgs, err := f.request(cmdGetWiphy, unix.NLM_F_DUMP, ifindex, nl.NewRtAttr(attrSplitWiphyDump, nil))
+	if err != nil {
+		return nil, err
+	}
+
+	byFreq := map[int]Channel{}
+	for _, m := range msgs {
+		attrs, err := parseAttrs(m)
+		if err != nil {
+			return nil, err
+		}
+		bands, err := nl.ParseRouteAttr(attrs[attrWiphyBands])
+		if err != nil {
+			return nil, err
+		}
+		for _, band := range bands {
+			battrs, err := parseAttrs(band.Value)
+			if err != nil {
+				return nil, err
+			}
+			freqs, err := nl.ParseRouteAttr(battrs[bandAttrFreqs])
+			if err != nil {
+				return nil, err
+			}
+			for _, freq := range freqs {
+				fattrs, err := parseAttrs(freq.Value)
+				if err != nil {
+					return nil, err
+				}
+				mhz, ok := attrUint32(fattrs, freqAttrFreq)
+				if !ok {
+					continue
+				}
+				_, disabled := fattrs[freqAttrDisabled]
+				_, noIR := fattrs[freqAttrNoIR]
+				_, radar := fattrs[freqAttrRadar]
+				byFreq[int(mhz)] = Channel{
+					Frequency: int(mhz),
+					Channel:   FrequencyChannel(int(mhz)),
+					Disabled:  disabled,
+					NoIR:      noIR,
+					Radar:     radar,
+				}
+			}
+		}
+	}
+
+	out := make([]Channel, 0, len(byFreq))
+	for _, ch := range byFreq {
+		out = append(out, ch)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Frequency < out[j].Frequency })
+	return out, nil
+}
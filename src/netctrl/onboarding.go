@@ -0,0 +1,150 @@
+package netctrl
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"netctrl/hostapd"
+	"qrcode"
+	"strings"
+	"time"
+)
+
+var (
+	errQRDisabled  = errors.New("QR codes are not enabled")
+	errWPSDisabled = errors.New("WPS is not enabled")
+)
+
+// WPSState describes WPS push-button configuration.
+type WPSState struct {
+	Enabled bool `json:"enabled"`
+	// Active is true while devices can join with WPS, until Expires.
+	Active  bool               `json:"active"`
+	Expires *time.Time         `json:"expires,omitempty"`
+	Status  *hostapd.WPSStatus `json:"status,omitempty"`
+}
+
+// wifiQRReplacer escapes the characters which are special in WIFI: URIs.
+var wifiQRReplacer = strings.NewReplacer(`\`, `\\`, `;`, `\;`, `,`, `\,`, `:`, `\:`, `"`, `\"`)
+
+// wifiQRString returns the WIFI: URI phones read from QR codes to join a
+// network.
+func wifiQRString(ssid, password, security string, hidden bool) string {
+	t := "WPA"
+	switch security {
+	case "open":
+		t = "nopass"
+	case "wpa3":
+		t = "SAE"
+	}
+	out := "WIFI:T:" + t + ";S:" + wifiQRReplacer.Replace(ssid) + ";"
+	if security != "open" {
+		out += "P:" + wifiQRReplacer.Replace(password) + ";"
+	}
+	if hidden {
+		out += "H:true;"
+	}
+	return out + ";"
+}
+
+// OnMainNetwork returns true if ip is on the main network's subnet, rather
+// than an additional network's, or outside rnd's networks.
+func (c *Controller) OnMainNetwork(ip net.IP) bool {
+	return ip != nil && c.subnet.Contains(ip)
+}
+
+// WifiQR returns a QR code for joining the named additional network, or the
+// main network if name is empty.
+func (c *Controller) WifiQR(name string) (*qrcode.Code, error) {
+	wl := &c.config.Network.Wireless
+	if !wl.QRCode {
+		return nil, errQRDisabled
+	}
+	if name == "" {
+		c.apLock.Lock()
+		s := wifiQRString(wl.SSID, wl.Password, wl.Security, wl.Hidden)
+		c.apLock.Unlock()
+		return qrcode.Encode([]byte(s))
+	}
+	for _, n := range wl.Networks {
+		if n.Name == name {
+			return qrcode.Encode([]byte(wifiQRString(n.SSID, n.Password, n.Security, n.Hidden)))
+		}
+	}
+	return nil, fmt.Errorf("no network named %q", name)
+}
+
+// StartWPS lets devices join the main network by pushing their WPS button,
+// until the configured timeout.
+func (c *Controller) StartWPS() error {
+	if !c.config.Network.Wireless.WPS {
+		return errWPSDisabled
+	}
+	timeout, err := time.ParseDuration(c.config.Network.Wireless.WPSTimeout)
+	if err != nil {
+		return err
+	}
+	h := c.hostapdClients[c.config.Network.Wireless.Interface]
+	if err := h.WPSPushButton(); err != nil {
+		return err
+	}
+
+	c.apLock.Lock()
+	if c.wpsTimer != nil {
+		c.wpsTimer.Stop()
+	}
+	c.wpsExpires = time.Now().Add(timeout)
+	c.wpsTimer = time.AfterFunc(timeout, func() {
+		if err := c.CancelWPS(); err != nil {
+			fmt.Printf("Failed to cancel WPS: %v\n", err)
+		}
+	})
+	c.apLock.Unlock()
+	c.refreshWPS()
+	return nil
+}
+
+// CancelWPS stops devices joining with WPS.
+func (c *Controller) CancelWPS() error {
+	if !c.config.Network.Wireless.WPS {
+		return errWPSDisabled
+	}
+	c.apLock.Lock()
+	if c.wpsTimer != nil {
+		c.wpsTimer.Stop()
+		c.wpsTimer = nil
+	}
+	c.wpsExpires = time.Time{}
+	c.apLock.Unlock()
+
+	err := c.hostapdClients[c.config.Network.Wireless.Interface].WPSCancel()
+	c.refreshWPS()
+	return err
+}
+
+// refreshWPS updates the state of WPS push-button configuration.
+func (c *Controller) refreshWPS() {
+	if !c.config.Network.Wireless.WPS {
+		return
+	}
+	st, err := c.hostapdClients[c.config.Network.Wireless.Interface].WPSStatus()
+	if err != nil {
+		return
+	}
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	c.lastWPS = st
+}
+
+// WPSState returns the state of WPS push-button configuration.
+func (c *Controller) WPSState() WPSState {
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	out := WPSState{Enabled: c.config.Network.Wireless.WPS, Status: c.lastWPS}
+	if c.lastWPS != nil && c.lastWPS.PBCStatus == "Active" && !c.wpsExpires.IsZero() {
+		out.Active = true
+		expires := c.wpsExpires
+		out.Expires = &expires
+	}
+	return out
+}
@@ -0,0 +1,79 @@
+package netctrl
+
+import (
+	"strings"
+	"testing"
+)
+
+// parseWifiQR splits a WIFI: URI into its fields, undoing the escaping.
+func parseWifiQR(t *testing.T, s string) map[string]string {
+	if !strings.HasPrefix(s, "WIFI:") || !strings.HasSuffix(s, ";;") {
+		t.Fatalf("%q is not a WIFI: URI", s)
+	}
+	fields := map[string]string{}
+	var key string
+	var val strings.Builder
+	inValue := false
+	rest := s[len("WIFI:") : len(s)-1]
+	for i := 0; i < len(rest); i++ {
+		switch ch := rest[i]; {
+		case ch == '\\' && inValue:
+			i++
+			if i == len(rest) {
+				t.Fatalf("%q ends in an escape", s)
+			}
+			val.WriteByte(rest[i])
+		case ch == ':' && !inValue:
+			inValue = true
+		case ch == ';':
+			if !inValue {
+				t.Fatalf("%q has a field without a value", s)
+			}
+			if _, ok := fields[key]; ok {
+				t.Fatalf("%q has field %s more than once", s, key)
+			}
+			fields[key] = val.String()
+			key, inValue = "", false
+			val.Reset()
+		case inValue:
+			val.WriteByte(ch)
+		default:
+			key += string(ch)
+		}
+	}
+	if key != "" || inValue {
+		t.Fatalf("%q has an unterminated field", s)
+	}
+	return fields
+}
+
+func TestWifiQRString(t *testing.T) {
+	tests := []struct {
+		ssid, password, security string
+		hidden                   bool
+		want                     map[string]string
+	}{
+		{"home", "password", "wpa2", false, map[string]string{"T": "WPA", "S": "home", "P": "password"}},
+		{"cafe", "", "open", false, map[string]string{"T": "nopass", "S": "cafe"}},
+		{"office", "hunter22", "wpa3", true, map[string]string{"T": "SAE", "S": "office", "P": "hunter22", "H": "true"}},
+		{"mixed", "hunter22", "wpa2-wpa3", false, map[string]string{"T": "WPA", "S": "mixed", "P": "hunter22"}},
+		{
+			`a;b:c,d\e"f`, `;;::,,\\""`, "wpa2", true,
+			map[string]string{"T": "WPA", "S": `a;b:c,d\e"f`, "P": `;;::,,\\""`, "H": "true"},
+		},
+		{`\`, `pass;`, "wpa2", false, map[string]string{"T": "WPA", "S": `\`, "P": `pass;`}},
+	}
+	for _, tc := range tests {
+		s := wifiQRString(tc.ssid, tc.password, tc.security, tc.hidden)
+		got := parseWifiQR(t, s)
+		if len(got) != len(tc.want) {
+			t.Errorf("wifiQRString(%q, %q, %q, %v) = %q, want fields %v", tc.ssid, tc.password, tc.security, tc.hidden, s, tc.want)
+			continue
+		}
+		for k, v := range tc.want {
+			if got[k] != v {
+				t.Errorf("wifiQRString(%q, %q, %q, %v) = %q, field %s is %q, want %q", tc.ssid, tc.password, tc.security, tc.hidden, s, k, got[k], v)
+			}
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package netctrl
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// persistentState is controller state which is saved to disk, so it
+// survives a restart of the daemon.
+type persistentState struct {
+	lock sync.Mutex
+	path string
+
+	// Approvals maps the MAC address of captive portal clients to the
+	// time their approval expires.
+	Approvals map[string]time.Time `json:"approvals"`
+	// DeniedMACs and AllowedMACs map the MAC address of stations on the
+	// hostapd deny and accept lists to when they were added.
+	DeniedMACs  map[string]time.Time `json:"denied_macs"`
+	AllowedMACs map[string]time.Time `json:"allowed_macs"`
+	// UplinkNetworks are the upstream networks saved through the API,
+	// keyed by SSID.
+	UplinkNetworks map[string]savedUplinkNetwork `json:"uplink_networks"`
+}
+
+// loadPersistentState reads state from the file at path. A missing file
+// is not an error, and results in empty state.
+func loadPersistentState(path string) (*persistentState, error) {
+	s := &persistentState{path: path}
+	d, err := ioutil.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(d, s); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Approvals == nil {
+		s.Approvals = map[string]time.Time{}
+	}
+	if s.DeniedMACs == nil {
+		s.DeniedMACs = map[string]time.Time{}
+	}
+	if s.AllowedMACs == nil {
+		s.AllowedMACs = map[string]time.Time{}
+	}
+	if s.UplinkNetworks == nil {
+		s.UplinkNetworks = map[string]savedUplinkNetwork{}
+	}
+	return s, nil
+}
+
+// save writes the state to disk. The caller must hold s.lock.
+func (s *persistentState) save() error {
+	d, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(s.path), ".rnd-state")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(d); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
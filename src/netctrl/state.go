@@ -21,11 +21,24 @@ type ControllerState struct {
 		} `json:"vpn"`
 		Subnet   string `json:"subnet"`
 		Wireless struct {
-			SSID string `json:"SSID"`
+			SSID   string `json:"SSID"`
+			QRCode bool   `json:"qr_code"`
 		} `json:"wireless"`
 	} `json:"config"`
 
-	AP *hostapd.APStatus `json:"AP"`
+	Networks []NetworkState `json:"networks,omitempty"`
+	Wired    []WiredState   `json:"wired,omitempty"`
+	Uplink   *UplinkState   `json:"uplink,omitempty"`
+
+	AP      *hostapd.APStatus `json:"AP"`
+	Hostapd HostapdState      `json:"hostapd"`
+	WPS     WPSState          `json:"WPS"`
+
+	DNS struct {
+		Upstreams []UpstreamStatus `json:"upstreams"`
+		Forwards  []UpstreamStatus `json:"forwards"`
+		Cache     DNSCacheStats    `json:"cache"`
+	} `json:"DNS"`
 }
 
 // GetState returns the status of the controller.
@@ -37,7 +50,18 @@ func (c *Controller) GetState() *ControllerState {
 	out.Config.VPN.Configured = c.vpnInterface != nil
 	out.Config.VPN.Name = c.vpnConf.Name
 	out.Config.VPN.Icon = c.vpnConf.Icon
+	out.Config.Wireless.QRCode = c.config.Network.Wireless.QRCode
+	out.WPS = c.WPSState()
+	out.Hostapd = c.HostapdState()
+	out.Networks = c.NetworkStates()
+	out.Wired = c.WiredStates()
+	out.Uplink = c.Uplink()
+	c.apLock.Lock()
 	out.Config.Wireless.SSID = c.config.Network.Wireless.SSID
 	out.AP = c.lastAPState
+	c.apLock.Unlock()
+	out.DNS.Upstreams = c.defaultDNSUpstreams().Status()
+	out.DNS.Forwards = c.dnsForwarder.Status()
+	out.DNS.Cache = c.dnsCache.Stats()
 	return out
 }
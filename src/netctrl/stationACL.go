@@ -0,0 +1,166 @@
+package netctrl
+
+import (
+	"net"
+	"netctrl/hostapd"
+	"sort"
+	"time"
+)
+
+// StationACL describes the stations on the deny and accept lists.
+type StationACL struct {
+	// AllowlistEnabled is true if only allowed stations may connect.
+	AllowlistEnabled bool              `json:"allowlist_enabled"`
+	Denied           []StationACLEntry `json:"denied"`
+	Allowed          []StationACLEntry `json:"allowed"`
+}
+
+// StationACLEntry is a station on the deny or accept list.
+type StationACLEntry struct {
+	MAC   string    `json:"mac"`
+	Added time.Time `json:"added"`
+}
+
+func aclEntries(macs map[string]time.Time) []StationACLEntry {
+	out := []StationACLEntry{}
+	for mac, added := range macs {
+		out = append(out, StationACLEntry{MAC: mac, Added: added})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].MAC < out[j].MAC })
+	return out
+}
+
+// StationACL returns the stations on the deny and accept lists.
+func (c *Controller) StationACL() StationACL {
+	c.state.lock.Lock()
+	defer c.state.lock.Unlock()
+	return StationACL{
+		AllowlistEnabled: c.config.Network.Wireless.MACAllowlist,
+		Denied:           aclEntries(c.state.DeniedMACs),
+		Allowed:          aclEntries(c.state.AllowedMACs),
+	}
+}
+
+// forEachHostapd runs fn against the control client for each SSID,
+// returning the first error.
+func (c *Controller) forEachHostapd(fn func(h *hostapd.Client) error) error {
+	var firstErr error
+	for _, iface := range c.hostapdInterfaces() {
+		if err := fn(c.hostapdClients[iface]); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// KickStation disconnects a station, which may then reconnect. If
+// disassociate is set, it remains authenticated.
+func (c *Controller) KickStation(mac string, disassociate bool) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	// The station is associated with at most one SSID, and hostapd does not
+	// fail commands for stations it does not know, so try them all.
+	return c.forEachHostapd(func(h *hostapd.Client) error {
+		if disassociate {
+			return h.Disassociate(hw.String())
+		}
+		return h.Deauthenticate(hw.String())
+	})
+}
+
+// updateACL adds or removes mac from a persisted list.
+func (c *Controller) updateACL(list map[string]time.Time, mac string, add bool) error {
+	c.state.lock.Lock()
+	defer c.state.lock.Unlock()
+	if add {
+		list[mac] = time.Now()
+	} else {
+		delete(list, mac)
+	}
+	return c.state.save()
+}
+
+// BanStation disconnects a station, and stops it reconnecting.
+func (c *Controller) BanStation(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if err := c.updateACL(c.state.DeniedMACs, hw.String(), true); err != nil {
+		return err
+	}
+	return c.forEachHostapd(func(h *hostapd.Client) error {
+		return h.DenyMAC(hw.String())
+	})
+}
+
+// UnbanStation lets a banned station connect again.
+func (c *Controller) UnbanStation(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if err := c.updateACL(c.state.DeniedMACs, hw.String(), false); err != nil {
+		return err
+	}
+	return c.forEachHostapd(func(h *hostapd.Client) error {
+		return h.UndenyMAC(hw.String())
+	})
+}
+
+// AllowStation adds a station to the accept list, which lets it connect if
+// the MAC allowlist is enabled.
+func (c *Controller) AllowStation(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if err := c.updateACL(c.state.AllowedMACs, hw.String(), true); err != nil {
+		return err
+	}
+	return c.forEachHostapd(func(h *hostapd.Client) error {
+		return h.AcceptMAC(hw.String())
+	})
+}
+
+// DisallowStation removes a station from the accept list.
+func (c *Controller) DisallowStation(mac string) error {
+	hw, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	if err := c.updateACL(c.state.AllowedMACs, hw.String(), false); err != nil {
+		return err
+	}
+	return c.forEachHostapd(func(h *hostapd.Client) error {
+		return h.UnacceptMAC(hw.String())
+	})
+}
+
+// applyStationACL loads the persisted deny and accept lists into hostapd,
+// which starts with them empty.
+func (c *Controller) applyStationACL(h *hostapd.Client) error {
+	c.state.lock.Lock()
+	var denied, allowed []string
+	for mac := range c.state.DeniedMACs {
+		denied = append(denied, mac)
+	}
+	for mac := range c.state.AllowedMACs {
+		allowed = append(allowed, mac)
+	}
+	c.state.lock.Unlock()
+
+	for _, mac := range denied {
+		if err := h.DenyMAC(mac); err != nil {
+			return err
+		}
+	}
+	for _, mac := range allowed {
+		if err := h.AcceptMAC(mac); err != nil {
+			return err
+		}
+	}
+	return nil
+}
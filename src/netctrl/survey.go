@@ -0,0 +1,273 @@
+package netctrl
+
+import (
+	"config"
+	"errors"
+	"fmt"
+	"netctrl/nl80211"
+	"strings"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	surveyScanTimeout = 15 * time.Second
+	// surveyMinInterval stops the survey repeating within the same quiet
+	// hours.
+	surveyMinInterval = 12 * time.Hour
+	// surveySwitchRatio is how much better another channel must score than
+	// the current one to switch to it.
+	surveySwitchRatio = 0.75
+)
+
+// SurveyChannel is a channel hostapd could use, scored by how crowded it
+// is. Lower scores are better.
+type SurveyChannel struct {
+	Channel   int `json:"channel"`
+	Frequency int `json:"frequency"`
+	// Networks counts the networks on, or overlapping, the channel.
+	Networks        int     `json:"networks"`
+	StrongestSignal *int    `json:"strongest_signal,omitempty"`
+	Score           float64 `json:"score"`
+}
+
+// Survey is the result of scanning for other networks to pick a channel.
+type Survey struct {
+	Time     time.Time       `json:"time"`
+	Channels []SurveyChannel `json:"channels"`
+	Networks []nl80211.BSS   `json:"networks"`
+	// Selected is the channel chosen.
+	Selected int    `json:"selected"`
+	Error    string `json:"error,omitempty"`
+}
+
+// usableChannels returns the channels in the configured band which an AP
+// can be started on without DFS, given the HT40 capabilities.
+func usableChannels(conf *config.Config, chans []nl80211.Channel) []nl80211.Channel {
+	band := conf.Network.Wireless.Band
+	usable := map[int]bool{}
+	for _, ch := range chans {
+		if ch.Disabled || ch.NoIR || ch.Radar || ch.Channel == 0 {
+			continue
+		}
+		if (band == "5") != (ch.Frequency > 5000) {
+			continue
+		}
+		usable[ch.Channel] = true
+	}
+
+	htCapab := conf.Network.Wireless.HTCapab
+	var out []nl80211.Channel
+	for _, ch := range chans {
+		if !usable[ch.Channel] {
+			continue
+		}
+		// Other 2.4GHz channels overlap two of these.
+		if band != "5" && ch.Channel != 1 && ch.Channel != 6 && ch.Channel != 11 {
+			continue
+		}
+		if strings.Contains(htCapab, "[HT40+]") && !ht40Usable(band, ch.Channel, true, usable) {
+			continue
+		}
+		if strings.Contains(htCapab, "[HT40-]") && !ht40Usable(band, ch.Channel, false, usable) {
+			continue
+		}
+		out = append(out, ch)
+	}
+	return out
+}
+
+// ht40Usable returns whether a 40MHz channel can be formed with channel as
+// the primary, and the secondary above it (plus) or below.
+func ht40Usable(band string, channel int, plus bool, usable map[int]bool) bool {
+	secondary := channel - 4
+	if plus {
+		secondary = channel + 4
+	}
+	if !usable[secondary] {
+		return false
+	}
+	if band != "5" {
+		return true
+	}
+	// 5GHz channels pair up as 36+40, 44+48, and so on.
+	base := channel
+	if channel >= 149 {
+		base--
+	}
+	return ((base/4)%2 == 1) == plus
+}
+
+// overlap returns how much a network on freq interferes with a channel at
+// chFreq, from 0 to 1.
+func overlap(chFreq, freq int) float64 {
+	if chFreq > 5000 {
+		if chFreq == freq {
+			return 1
+		}
+		return 0
+	}
+	d := chFreq - freq
+	if d < 0 {
+		d = -d
+	}
+	if d >= 25 {
+		return 0
+	}
+	return 1 - float64(d)/25
+}
+
+// scoreChannel scores a channel by the networks overlapping it, weighting
+// each by its signal.
+func scoreChannel(ch nl80211.Channel, networks []nl80211.BSS) SurveyChannel {
+	out := SurveyChannel{Channel: ch.Channel, Frequency: ch.Frequency}
+	for _, n := range networks {
+		o := overlap(ch.Frequency, n.Frequency)
+		if o == 0 {
+			continue
+		}
+		out.Networks++
+		if out.StrongestSignal == nil || n.Signal > *out.StrongestSignal {
+			signal := n.Signal
+			out.StrongestSignal = &signal
+		}
+		// A network at -40dBm counts for 7, one at -90dBm for 2.
+		weight := 1.0
+		if n.Signal > -100 {
+			weight += float64(n.Signal+100) / 10
+		}
+		out.Score += o * weight
+	}
+	return out
+}
+
+// runSurvey scans for other networks with the main wireless interface, and
+// scores the channels hostapd could use. hostapd must not be running.
+func (c *Controller) runSurvey() (*Survey, error) {
+	wl := &c.config.Network.Wireless
+	if wl.CountryCode != "" {
+		if err := nl80211.SetRegulatoryDomain(wl.CountryCode); err != nil {
+			fmt.Printf("Failed to set regulatory domain: %v\n", err)
+		}
+	}
+	link, err := netlink.LinkByName(wl.Interface)
+	if err != nil {
+		return nil, err
+	}
+	if err := netlink.LinkSetUp(link); err != nil {
+		return nil, err
+	}
+
+	networks, err := nl80211.Scan(wl.Interface, surveyScanTimeout)
+	if err != nil {
+		return nil, err
+	}
+	chans, err := nl80211.Channels(wl.Interface)
+	if err != nil {
+		return nil, err
+	}
+	out := &Survey{Time: time.Now(), Networks: networks}
+	for _, ch := range usableChannels(c.config, chans) {
+		out.Channels = append(out.Channels, scoreChannel(ch, networks))
+	}
+	if len(out.Channels) == 0 {
+		return nil, errors.New("no usable channels")
+	}
+	return out, nil
+}
+
+// surveyChannel sets the channel for hostapd from a site survey. Unless
+// starting, the current channel is kept if no other is much better. The
+// caller must hold setupLock, and hostapd must not be running.
+func (c *Controller) surveyChannel(starting bool) {
+	wl := &c.config.Network.Wireless
+	s, err := c.runSurvey()
+	if err != nil {
+		fmt.Printf("Channel survey failed, using the configured channel: %v\n", err)
+		s = &Survey{Time: time.Now(), Selected: wl.Channel, Error: err.Error()}
+	} else {
+		best := s.Channels[0]
+		var current *SurveyChannel
+		for i, ch := range s.Channels {
+			if ch.Score < best.Score {
+				best = ch
+			}
+			if ch.Channel == wl.Channel {
+				current = &s.Channels[i]
+			}
+		}
+		s.Selected = best.Channel
+		if !starting && current != nil && best.Score >= current.Score*surveySwitchRatio {
+			s.Selected = current.Channel
+		}
+		if s.Selected != wl.Channel {
+			fmt.Printf("Channel survey picked channel %d (score %.1f)\n", s.Selected, best.Score)
+		}
+	}
+
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	wl.Channel = s.Selected
+	c.lastSurvey = s
+}
+
+// Survey returns the last site survey, or nil if there has not been one.
+func (c *Controller) Survey() *Survey {
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	return c.lastSurvey
+}
+
+// inTimeRange returns whether t is between start and end, as offsets from
+// midnight. The range may span midnight.
+func inTimeRange(t time.Time, start, end time.Duration) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	offset := t.Sub(midnight)
+	if start < end {
+		return offset >= start && offset < end
+	}
+	return offset >= start || offset < end
+}
+
+// surveyRoutine repeats the site survey during the quiet hours, once a
+// night, if no stations are connected.
+func (c *Controller) surveyRoutine() {
+	defer c.wg.Done()
+	start, end, err := config.ParseTimeRange(c.config.Network.Wireless.SurveyQuietHours)
+	if err != nil {
+		return
+	}
+	t := time.NewTicker(10 * time.Minute)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case now := <-t.C:
+			if !inTimeRange(now, start, end) {
+				continue
+			}
+			if last := c.Survey(); last != nil && now.Sub(last.Time) < surveyMinInterval {
+				continue
+			}
+			if len(c.Stations()) > 0 {
+				continue
+			}
+			c.resurvey()
+		}
+	}
+}
+
+// resurvey stops hostapd to survey the channels, then starts it again.
+func (c *Controller) resurvey() {
+	c.setupLock.Lock()
+	defer c.setupLock.Unlock()
+	c.stopHostapd()
+	c.surveyChannel(false)
+	if err := c.startHostapd(); err != nil {
+		fmt.Printf("Failed to start hostapd after channel survey: %v\n", err)
+		c.failedHostapdStart(err)
+	}
+}
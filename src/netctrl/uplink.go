@@ -0,0 +1,659 @@
+package netctrl
+
+import (
+	"config"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"netctrl/hostapd"
+	"netctrl/wpasupplicant"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishvananda/netlink"
+)
+
+const (
+	uplinkCtrlDir      = "/var/run/wpa_supplicant"
+	uplinkRestartDelay = 5 * time.Second
+	uplinkDHCPRetry    = 10 * time.Second
+	// uplinkLeaseWait is how long startup waits for the uplink to get an
+	// address, so the VPN can come up over it.
+	uplinkLeaseWait = 30 * time.Second
+	// uplinkRouteMetric prefers the uplink over other default routes, such
+	// as one through a wired management interface.
+	uplinkRouteMetric = 50
+)
+
+var errNoUplink = errors.New("no uplink interface is configured")
+
+// UplinkState describes the connection to the upstream network.
+type UplinkState struct {
+	Interface string `json:"interface"`
+	// Status is nil while wpa_supplicant is not running.
+	Status       *wpasupplicant.Status      `json:"status"`
+	Address      string                     `json:"address,omitempty"`
+	Gateway      string                     `json:"gateway,omitempty"`
+	LeaseExpires *time.Time                 `json:"lease_expires,omitempty"`
+	Networks     []UplinkNetworkState       `json:"networks"`
+	ScanResults  []wpasupplicant.ScanResult `json:"scan_results"`
+}
+
+// UplinkNetworkState is a network the uplink joins when in range.
+type UplinkNetworkState struct {
+	config.UplinkNetwork
+	// Saved networks were added through the API, rather than configured.
+	Saved bool `json:"saved"`
+}
+
+// savedUplinkNetwork is a network added through the API, persisted by
+// SSID.
+type savedUplinkNetwork struct {
+	Password string `json:"password"`
+	Hidden   bool   `json:"hidden"`
+	Priority int    `json:"priority"`
+}
+
+// uplink is the wpa_supplicant managing the uplink interface, and the
+// state it reports.
+type uplink struct {
+	iface  string
+	client *wpasupplicant.Client
+	events chan hostapd.Event
+	// vpnRestart asks the VPN routine to reconnect the VPN, as the
+	// uplink's address changed.
+	vpnRestart chan struct{}
+
+	// lock guards the fields below. It is held while networks are changed,
+	// so they match netIDs.
+	lock sync.Mutex
+	proc *exec.Cmd
+	// done is closed when proc exits.
+	done   chan struct{}
+	status *wpasupplicant.Status
+	scan   []wpasupplicant.ScanResult
+	lease  *dhcpLease
+	// netIDs maps the SSID of each network to its ID in wpa_supplicant.
+	netIDs map[string]int
+	// dhcpStop is closed to stop the DHCP routine for the current
+	// association, if there is one.
+	dhcpStop chan struct{}
+}
+
+// startSupplicant starts wpa_supplicant, and waits up to 8 seconds for its
+// control socket to respond.
+func (u *uplink) startSupplicant() error {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err = f.Write([]byte(wpasupplicant.ConfigFile(uplinkCtrlDir))); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	proc := exec.Command("wpa_supplicant", "-i", u.iface, "-D", "nl80211", "-c", f.Name())
+	proc.Stdout = os.Stdout
+	proc.Stderr = os.Stderr
+	if err := proc.Start(); err != nil {
+		return err
+	}
+	done := make(chan struct{})
+	go func() {
+		proc.Wait()
+		close(done)
+	}()
+	u.lock.Lock()
+	u.proc, u.done = proc, done
+	u.lock.Unlock()
+
+	timeout := time.NewTimer(8 * time.Second)
+	checker := time.NewTicker(220 * time.Millisecond)
+	defer timeout.Stop()
+	defer checker.Stop()
+	for {
+		select {
+		case <-timeout.C:
+			return errors.New("timeout waiting for wpa_supplicant to come up")
+		case <-done:
+			return errors.New("wpa_supplicant has stopped")
+		case <-checker.C:
+			resp, err := hostapd.Query(filepath.Join(uplinkCtrlDir, u.iface), "PING")
+			if err == nil && strings.TrimSpace(string(resp)) == "PONG" {
+				return nil
+			}
+		}
+	}
+}
+
+// stopSupplicant kills wpa_supplicant, and waits for it to exit.
+func (u *uplink) stopSupplicant() {
+	u.lock.Lock()
+	proc, done := u.proc, u.done
+	u.proc = nil
+	u.lock.Unlock()
+	if proc == nil {
+		return
+	}
+	proc.Process.Kill()
+	<-done
+}
+
+// startUplink starts wpa_supplicant on the uplink interface, and connects
+// to it. Networks are added once the client attaches.
+func (c *Controller) startUplink() error {
+	u := &uplink{
+		iface:      c.config.Network.Uplink.Interface,
+		events:     make(chan hostapd.Event, 64),
+		vpnRestart: make(chan struct{}, 1),
+		netIDs:     map[string]int{},
+	}
+	if err := u.startSupplicant(); err != nil {
+		u.stopSupplicant()
+		return fmt.Errorf("starting wpa_supplicant on %s: %v", u.iface, err)
+	}
+	u.client = wpasupplicant.NewClient(filepath.Join(uplinkCtrlDir, u.iface), u.events)
+	c.uplink = u
+	return nil
+}
+
+// closeUplink disconnects from wpa_supplicant and stops it. The DHCP
+// routine releases the lease as the controller shuts down.
+func (c *Controller) closeUplink() {
+	if c.uplink == nil {
+		return
+	}
+	c.uplink.client.Close()
+	c.uplink.stopSupplicant()
+}
+
+// uplinkRoutine follows the events from wpa_supplicant, and restarts it if
+// it exits.
+func (c *Controller) uplinkRoutine() {
+	defer c.wg.Done()
+	u := c.uplink
+	t := time.NewTicker(5 * time.Second)
+	defer t.Stop()
+
+	for {
+		u.lock.Lock()
+		done := u.done
+		u.lock.Unlock()
+
+		select {
+		case <-c.shutdown:
+			return
+		case e := <-u.events:
+			c.handleUplinkEvent(e)
+		case <-t.C:
+			c.refreshUplinkStatus()
+		case <-done:
+			fmt.Println("wpa_supplicant stopped, restarting")
+			c.stopUplinkDHCP()
+			u.lock.Lock()
+			u.status = nil
+			u.lock.Unlock()
+			select {
+			case <-c.shutdown:
+				return
+			case <-time.After(uplinkRestartDelay):
+			}
+			// The client reattaches by itself, which adds the networks.
+			if err := u.startSupplicant(); err != nil {
+				fmt.Printf("Failed to restart wpa_supplicant: %v\n", err)
+				u.stopSupplicant()
+			}
+		}
+	}
+}
+
+func (c *Controller) handleUplinkEvent(e hostapd.Event) {
+	switch e.Name {
+	case hostapd.EventAttached:
+		// wpa_supplicant may have restarted, forgetting its networks.
+		if err := c.configureUplink(); err != nil {
+			fmt.Printf("Failed to configure uplink networks: %v\n", err)
+		}
+		c.refreshUplinkStatus()
+	case wpasupplicant.EventConnected:
+		c.refreshUplinkStatus()
+		c.startUplinkDHCP()
+	case wpasupplicant.EventDisconnected:
+		c.stopUplinkDHCP()
+		c.refreshUplinkStatus()
+	case wpasupplicant.EventScanResults:
+		c.refreshUplinkScan()
+	}
+}
+
+// uplinkNetworks returns the configured networks, followed by those saved
+// through the API.
+func (c *Controller) uplinkNetworks() []UplinkNetworkState {
+	var out []UplinkNetworkState
+	configured := map[string]bool{}
+	for _, n := range c.config.Network.Uplink.Networks {
+		out = append(out, UplinkNetworkState{UplinkNetwork: n})
+		configured[n.SSID] = true
+	}
+
+	c.state.lock.Lock()
+	defer c.state.lock.Unlock()
+	var saved []UplinkNetworkState
+	for ssid, n := range c.state.UplinkNetworks {
+		if configured[ssid] {
+			continue
+		}
+		saved = append(saved, UplinkNetworkState{
+			UplinkNetwork: config.UplinkNetwork{SSID: ssid, Password: n.Password, Hidden: n.Hidden, Priority: n.Priority},
+			Saved:         true,
+		})
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].SSID < saved[j].SSID })
+	return append(out, saved...)
+}
+
+func supplicantNetwork(n *config.UplinkNetwork) *wpasupplicant.Network {
+	return &wpasupplicant.Network{SSID: n.SSID, Password: n.Password, Hidden: n.Hidden, Priority: n.Priority}
+}
+
+// configureUplink replaces the networks in wpa_supplicant with the known
+// networks, then scans for them.
+func (c *Controller) configureUplink() error {
+	networks := c.uplinkNetworks()
+	u := c.uplink
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if err := u.client.RemoveNetworks(); err != nil {
+		return err
+	}
+	u.netIDs = map[string]int{}
+	for _, n := range networks {
+		id, err := u.client.AddNetwork(supplicantNetwork(&n.UplinkNetwork))
+		if err != nil {
+			return fmt.Errorf("adding %q: %v", n.SSID, err)
+		}
+		u.netIDs[n.SSID] = id
+	}
+	return u.client.Scan()
+}
+
+// refreshUplinkStatus updates the connection state of the uplink.
+func (c *Controller) refreshUplinkStatus() {
+	s, err := c.uplink.client.Status()
+	if err != nil {
+		s = nil
+	}
+	c.uplink.lock.Lock()
+	defer c.uplink.lock.Unlock()
+	c.uplink.status = s
+}
+
+// refreshUplinkScan updates the networks found by the last scan.
+func (c *Controller) refreshUplinkScan() {
+	results, err := c.uplink.client.ScanResults()
+	if err != nil {
+		fmt.Printf("Failed to read uplink scan results: %v\n", err)
+		return
+	}
+	c.uplink.lock.Lock()
+	defer c.uplink.lock.Unlock()
+	c.uplink.scan = results
+}
+
+// startUplinkDHCP starts obtaining an address for the uplink, unless it
+// already is, such as after roaming to another access point.
+func (c *Controller) startUplinkDHCP() {
+	c.uplink.lock.Lock()
+	defer c.uplink.lock.Unlock()
+	if c.uplink.dhcpStop != nil {
+		return
+	}
+	c.uplink.dhcpStop = make(chan struct{})
+	c.wg.Add(1)
+	go c.uplinkDHCPRoutine(c.uplink.dhcpStop)
+}
+
+// stopUplinkDHCP stops the DHCP routine, which removes the uplink address.
+func (c *Controller) stopUplinkDHCP() {
+	c.uplink.lock.Lock()
+	defer c.uplink.lock.Unlock()
+	if c.uplink.dhcpStop != nil {
+		close(c.uplink.dhcpStop)
+		c.uplink.dhcpStop = nil
+	}
+}
+
+// uplinkDHCPRoutine keeps a lease for the uplink until stop is closed, or
+// the controller shuts down.
+func (c *Controller) uplinkDHCPRoutine(stop chan struct{}) {
+	defer c.wg.Done()
+	var d *dhcpClient
+	var lease *dhcpLease
+	defer func() {
+		if lease != nil {
+			d.release(lease)
+			c.removeUplinkLease(lease)
+		}
+		if d != nil {
+			d.Close()
+		}
+	}()
+
+	for {
+		wait := uplinkDHCPRetry
+		if d == nil {
+			// The previous routine may still hold the port briefly.
+			iface, err := net.InterfaceByName(c.uplink.iface)
+			if err == nil {
+				d, err = newDHCPClient(iface, stop)
+			}
+			if err != nil {
+				fmt.Printf("Failed to start uplink DHCP client: %v\n", err)
+			}
+		}
+		if d != nil {
+			lease, wait = c.renewUplinkLease(d, lease)
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-c.shutdown:
+			return
+		case <-time.After(wait):
+		}
+	}
+}
+
+// renewUplinkLease obtains a lease, or renews the one held, returning the
+// lease now held and how long to wait before renewing it.
+func (c *Controller) renewUplinkLease(d *dhcpClient, lease *dhcpLease) (*dhcpLease, time.Duration) {
+	var l *dhcpLease
+	var err error
+	if lease == nil {
+		l, err = d.acquire()
+	} else {
+		l, err = d.renew(lease)
+	}
+	switch {
+	case err == errDHCPStopped:
+		return lease, 0
+	case err != nil && lease == nil:
+		fmt.Printf("Failed to obtain an uplink address: %v\n", err)
+		return nil, uplinkDHCPRetry
+	case err != nil && err != errDHCPNak && time.Since(lease.Obtained) < lease.Duration:
+		// Keep using the lease until it expires.
+		fmt.Printf("Failed to renew the uplink lease: %v\n", err)
+		return lease, uplinkDHCPRetry
+	case err != nil:
+		fmt.Printf("Lost the uplink lease: %v\n", err)
+		c.removeUplinkLease(lease)
+		return nil, 0
+	}
+
+	if err := c.applyUplinkLease(lease, l); err != nil {
+		fmt.Printf("Failed to apply the uplink lease: %v\n", err)
+		if lease != nil {
+			c.removeUplinkLease(lease)
+		}
+		return nil, uplinkDHCPRetry
+	}
+	return l, l.Duration / 2
+}
+
+// applyUplinkLease assigns the address and default route from l to the
+// uplink, replacing those from old, if any. The VPN is restarted if the
+// address or gateway changed, as it was connected through the old ones.
+func (c *Controller) applyUplinkLease(old, l *dhcpLease) error {
+	link, err := netlink.LinkByName(c.uplink.iface)
+	if err != nil {
+		return err
+	}
+	if old != nil && old.Addr.String() != l.Addr.String() {
+		netlink.AddrDel(link, &netlink.Addr{IPNet: old.Addr})
+	}
+	if err := netlink.AddrReplace(link, &netlink.Addr{IPNet: l.Addr}); err != nil {
+		return err
+	}
+	if l.Gateway != nil {
+		if err := netlink.RouteReplace(&netlink.Route{LinkIndex: link.Attrs().Index, Gw: l.Gateway, Priority: uplinkRouteMetric}); err != nil {
+			return err
+		}
+	}
+
+	c.uplink.lock.Lock()
+	c.uplink.lease = l
+	c.uplink.lock.Unlock()
+
+	if old == nil || !old.Addr.IP.Equal(l.Addr.IP) || !old.Gateway.Equal(l.Gateway) {
+		fmt.Printf("Uplink has address %s, gateway %s\n", l.Addr, l.Gateway)
+		// Bringing the VPN up takes a while, so it must not hold up DHCP.
+		select {
+		case c.uplink.vpnRestart <- struct{}{}:
+		default:
+		}
+	}
+	return nil
+}
+
+// removeUplinkLease removes the address from l, along with the routes
+// through it, unless a newer lease has the same address.
+func (c *Controller) removeUplinkLease(l *dhcpLease) {
+	c.uplink.lock.Lock()
+	current := c.uplink.lease
+	if current == l {
+		c.uplink.lease = nil
+	}
+	c.uplink.lock.Unlock()
+	if current != nil && current != l && current.Addr.String() == l.Addr.String() {
+		return
+	}
+	if link, err := netlink.LinkByName(c.uplink.iface); err == nil {
+		netlink.AddrDel(link, &netlink.Addr{IPNet: l.Addr})
+	}
+}
+
+// uplinkVPNRoutine reconnects the VPN when the uplink's address changes.
+func (c *Controller) uplinkVPNRoutine() {
+	defer c.wg.Done()
+	for {
+		select {
+		case <-c.shutdown:
+			return
+		case <-c.uplink.vpnRestart:
+			c.restartVPN()
+		}
+	}
+}
+
+// restartVPN reconnects the current VPN, if one has been set.
+func (c *Controller) restartVPN() {
+	c.setupLock.Lock()
+	vpn := c.vpnConf
+	c.setupLock.Unlock()
+	if vpn == nil {
+		return
+	}
+	if err := c.SetVPN(vpn); err != nil {
+		fmt.Printf("Failed to restart VPN %q: %v\n", vpn.Name, err)
+	}
+}
+
+// waitUplinkLease waits up to uplinkLeaseWait for the uplink to get an
+// address.
+func (c *Controller) waitUplinkLease() {
+	timeout := time.NewTimer(uplinkLeaseWait)
+	checker := time.NewTicker(250 * time.Millisecond)
+	defer timeout.Stop()
+	defer checker.Stop()
+	for {
+		select {
+		case <-timeout.C:
+			fmt.Println("Uplink has no address yet, continuing without it")
+			return
+		case <-checker.C:
+			c.uplink.lock.Lock()
+			ok := c.uplink.lease != nil
+			c.uplink.lock.Unlock()
+			if ok {
+				return
+			}
+		}
+	}
+}
+
+// UplinkEnabled returns true if an uplink interface is configured.
+func (c *Controller) UplinkEnabled() bool {
+	return c.uplink != nil
+}
+
+// Uplink returns the state of the uplink, or nil if there is none.
+func (c *Controller) Uplink() *UplinkState {
+	if c.uplink == nil {
+		return nil
+	}
+	networks := c.uplinkNetworks()
+	if networks == nil {
+		networks = []UplinkNetworkState{}
+	}
+
+	u := c.uplink
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	out := &UplinkState{
+		Interface:   u.iface,
+		Status:      u.status,
+		Networks:    networks,
+		ScanResults: u.scan,
+	}
+	if out.ScanResults == nil {
+		out.ScanResults = []wpasupplicant.ScanResult{}
+	}
+	if u.lease != nil {
+		out.Address = u.lease.Addr.String()
+		if u.lease.Gateway != nil {
+			out.Gateway = u.lease.Gateway.String()
+		}
+		expires := u.lease.Obtained.Add(u.lease.Duration)
+		out.LeaseExpires = &expires
+	}
+	return out
+}
+
+// ScanUplink starts a scan for upstream networks. The results are in the
+// uplink state once it completes.
+func (c *Controller) ScanUplink() error {
+	if c.uplink == nil {
+		return errNoUplink
+	}
+	return c.uplink.client.Scan()
+}
+
+// ConnectUplink joins an upstream network, staying on it until it is
+// forgotten, AutoUplink is called, or rnd restarts. A known network may be
+// chosen by its SSID alone. If save is set, the network is joined again whenever it is in
+// range.
+func (c *Controller) ConnectUplink(n *config.UplinkNetwork, save bool) error {
+	if c.uplink == nil {
+		return errNoUplink
+	}
+	if err := n.Validate(); err != nil {
+		return err
+	}
+	if save {
+		for _, cn := range c.config.Network.Uplink.Networks {
+			if cn.SSID == n.SSID {
+				return fmt.Errorf("uplink network %q is already configured", n.SSID)
+			}
+		}
+	}
+
+	u := c.uplink
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	id, known := u.netIDs[n.SSID]
+	if !known || n.Password != "" {
+		if known {
+			if err := u.client.RemoveNetwork(id); err != nil {
+				return err
+			}
+			delete(u.netIDs, n.SSID)
+		}
+		var err error
+		if id, err = u.client.AddNetwork(supplicantNetwork(n)); err != nil {
+			return err
+		}
+		u.netIDs[n.SSID] = id
+	}
+	if err := u.client.SelectNetwork(id); err != nil {
+		return err
+	}
+	if !save || (known && n.Password == "") {
+		return nil
+	}
+
+	c.state.lock.Lock()
+	defer c.state.lock.Unlock()
+	c.state.UplinkNetworks[n.SSID] = savedUplinkNetwork{Password: n.Password, Hidden: n.Hidden, Priority: n.Priority}
+	return c.state.save()
+}
+
+// ForgetUplink removes a network saved through the API, or joined without
+// saving it. The uplink may then join any other known network in range.
+func (c *Controller) ForgetUplink(ssid string) error {
+	if c.uplink == nil {
+		return errNoUplink
+	}
+	for _, n := range c.config.Network.Uplink.Networks {
+		if n.SSID == ssid {
+			return fmt.Errorf("uplink network %q is configured, so cannot be forgotten", ssid)
+		}
+	}
+
+	c.state.lock.Lock()
+	_, saved := c.state.UplinkNetworks[ssid]
+	var err error
+	if saved {
+		delete(c.state.UplinkNetworks, ssid)
+		err = c.state.save()
+	}
+	c.state.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	u := c.uplink
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	id, joined := u.netIDs[ssid]
+	if !saved && !joined {
+		return fmt.Errorf("no saved or joined uplink network %q", ssid)
+	}
+	if joined {
+		if err := u.client.RemoveNetwork(id); err != nil {
+			return err
+		}
+		delete(u.netIDs, ssid)
+	}
+	return u.client.EnableNetworks()
+}
+
+// AutoUplink returns to joining any known network in range, after one was
+// chosen with ConnectUplink. Networks joined without saving them are
+// removed, and known ones are put back as they were configured or saved.
+func (c *Controller) AutoUplink() error {
+	if c.uplink == nil {
+		return errNoUplink
+	}
+	return c.configureUplink()
+}
@@ -0,0 +1,50 @@
+package netctrl
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+)
+
+// WiredState describes a wired interface on the bridge.
+type WiredState struct {
+	Name string `json:"name"`
+	// Carrier is set while a cable is plugged in.
+	Carrier bool `json:"carrier"`
+}
+
+// attachWiredInterfaces adds the wired interfaces to the bridge. They are
+// released when the bridge is deleted.
+func (c *Controller) attachWiredInterfaces() error {
+	for _, name := range c.config.Network.WiredInterfaces {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return fmt.Errorf("wired interface %s: %v", name, err)
+		}
+		if err := AttachNetBridge(c.bridgeInterface, iface); err != nil {
+			return fmt.Errorf("attaching %s to %s: %v", name, c.bridgeInterface.Name, err)
+		}
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetUp(link); err != nil {
+			return fmt.Errorf("bringing up %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// WiredStates returns the state of each wired interface.
+func (c *Controller) WiredStates() []WiredState {
+	out := make([]WiredState, 0, len(c.config.Network.WiredInterfaces))
+	for _, name := range c.config.Network.WiredInterfaces {
+		s := WiredState{Name: name}
+		if link, err := netlink.LinkByName(name); err == nil {
+			s.Carrier = link.Attrs().OperState == netlink.OperUp
+		}
+		out = append(out, s)
+	}
+	return out
+}
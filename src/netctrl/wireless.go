@@ -0,0 +1,165 @@
+package netctrl
+
+import (
+	"config"
+	"errors"
+	"fmt"
+	"netctrl/hostapd"
+)
+
+// WirelessUpdate changes settings of the main wireless network. Fields which
+// are not set are left as they are.
+type WirelessUpdate struct {
+	SSID     *string `json:"SSID"`
+	Password *string `json:"password"`
+	Hidden   *bool   `json:"hidden"`
+	Security *string `json:"security"`
+	PMF      *string `json:"pmf"`
+	Channel  *int    `json:"channel"`
+	ACS      *bool   `json:"acs"`
+}
+
+// UpdateWireless saves changes to the wireless settings to the
+// configuration file, and applies them. Where possible, they are applied to the
+// running hostapd, otherwise only hostapd is restarted, so the bridge, DHCP
+// leases and VPN stay up. Either way, stations must reconnect.
+func (c *Controller) UpdateWireless(u *WirelessUpdate) error {
+	if c.config.Network.Wireless.Interface == "" {
+		return errors.New("no wireless interface is configured")
+	}
+	c.setupLock.Lock()
+	defer c.setupLock.Unlock()
+
+	next := *c.config
+	wl, cur := &next.Network.Wireless, &c.config.Network.Wireless
+	// previous holds the saved values being replaced, to put back if they
+	// cannot be applied.
+	saved, previous := map[string]interface{}{}, map[string]interface{}{}
+	if u.SSID != nil {
+		wl.SSID = *u.SSID
+		saved["network.wireless.SSID"], previous["network.wireless.SSID"] = wl.SSID, cur.SSID
+	}
+	if u.Password != nil {
+		wl.Password = *u.Password
+		saved["network.wireless.password"], previous["network.wireless.password"] = wl.Password, cur.Password
+	}
+	if u.Hidden != nil {
+		wl.Hidden = *u.Hidden
+		saved["network.wireless.hidden"], previous["network.wireless.hidden"] = wl.Hidden, cur.Hidden
+	}
+	if u.Security != nil {
+		wl.Security = *u.Security
+		saved["network.wireless.security"], previous["network.wireless.security"] = wl.Security, cur.Security
+	}
+	if u.PMF != nil {
+		wl.PMF = *u.PMF
+		saved["network.wireless.pmf"], previous["network.wireless.pmf"] = wl.PMF, cur.PMF
+	}
+	if u.Channel != nil {
+		wl.Channel = *u.Channel
+		saved["network.wireless.channel"], previous["network.wireless.channel"] = wl.Channel, cur.Channel
+	}
+	if u.ACS != nil {
+		wl.ACS = *u.ACS
+		saved["network.wireless.acs"], previous["network.wireless.acs"] = wl.ACS, cur.ACS
+	}
+	if len(saved) == 0 {
+		return errors.New("no settings to change")
+	}
+	if err := next.Validate(); err != nil {
+		return err
+	}
+	if _, err := hostapd.GenerateConfig(&next); err != nil {
+		return err
+	}
+
+	// The file is written first, so a change is never live without being
+	// saved.
+	if err := c.config.UpdateFile(saved); err != nil {
+		return err
+	}
+	if err := c.applyWireless(&next); err != nil {
+		if restoreErr := c.config.UpdateFile(previous); restoreErr != nil {
+			fmt.Printf("Failed to restore the wireless settings in the configuration file: %v\n", restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// applyWireless switches hostapd to the wireless settings in next.
+func (c *Controller) applyWireless(next *config.Config) error {
+	current, err := hostapd.PrimarySettings(c.config)
+	if err != nil {
+		return err
+	}
+	settings, err := hostapd.PrimarySettings(next)
+	if err != nil {
+		return err
+	}
+	radioChanged := next.Network.Wireless.Channel != c.config.Network.Wireless.Channel ||
+		next.Network.Wireless.ACS != c.config.Network.Wireless.ACS
+
+	// Settings can be changed with SET if the same ones are written, so
+	// none would be left over from before.
+	if changed, ok := changedSettings(current, settings); ok && !radioChanged {
+		if len(changed) > 0 {
+			if err := c.hostapdClients[c.config.Network.Wireless.Interface].Apply(changed); err != nil {
+				return err
+			}
+		}
+		c.setWireless(next)
+		return nil
+	}
+
+	previous := *c.config
+	c.setWireless(next)
+	if err := c.restartHostapd(); err != nil {
+		c.setWireless(&previous)
+		if restoreErr := c.restartHostapd(); restoreErr != nil {
+			fmt.Printf("Failed to restore hostapd: %v\n", restoreErr)
+		}
+		return err
+	}
+	return nil
+}
+
+// setWireless copies the settings UpdateWireless changes from next. The
+// caller must hold setupLock.
+func (c *Controller) setWireless(next *config.Config) {
+	c.apLock.Lock()
+	defer c.apLock.Unlock()
+	wl, n := &c.config.Network.Wireless, &next.Network.Wireless
+	wl.SSID, wl.Password, wl.Hidden = n.SSID, n.Password, n.Hidden
+	wl.Security, wl.PMF = n.Security, n.PMF
+	wl.Channel, wl.ACS = n.Channel, n.ACS
+}
+
+// changedSettings returns the settings in next which differ from current,
+// and whether both contain the same keys, in the same order.
+func changedSettings(current, next []hostapd.Setting) ([]hostapd.Setting, bool) {
+	if len(current) != len(next) {
+		return nil, false
+	}
+	var out []hostapd.Setting
+	for i := range next {
+		if current[i].Key != next[i].Key {
+			return nil, false
+		}
+		if current[i].Value != next[i].Value {
+			out = append(out, next[i])
+		}
+	}
+	return out, true
+}
+
+// restartHostapd restarts hostapd with the current configuration. The
+// control clients reattach by themselves.
+func (c *Controller) restartHostapd() error {
+	c.stopHostapd()
+	if err := c.startHostapd(); err != nil {
+		c.failedHostapdStart(err)
+		return err
+	}
+	return nil
+}
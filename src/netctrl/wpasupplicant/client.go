@@ -0,0 +1,277 @@
+package wpasupplicant
+
+import (
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"netctrl/hostapd"
+	"strconv"
+	"strings"
+)
+
+// Events wpa_supplicant sends to attached clients.
+const (
+	EventConnected    = "CTRL-EVENT-CONNECTED"
+	EventDisconnected = "CTRL-EVENT-DISCONNECTED"
+	EventScanResults  = "CTRL-EVENT-SCAN-RESULTS"
+)
+
+// ConfigFile returns a minimal wpa_supplicant configuration, which leaves
+// networks to be added through the control socket in dir.
+func ConfigFile(dir string) string {
+	return "ctrl_interface=" + dir + "\nupdate_config=0\n"
+}
+
+// Network is a network wpa_supplicant may join.
+type Network struct {
+	SSID string
+	// Password is empty for open networks.
+	Password string
+	Hidden   bool
+	Priority int
+}
+
+// Status is the connection state, from STATUS.
+type Status struct {
+	// State is the wpa_state, such as "SCANNING" or "COMPLETED".
+	State string `json:"state"`
+	SSID  string `json:"SSID,omitempty"`
+	BSSID string `json:"BSSID,omitempty"`
+	// Frequency is in MHz.
+	Frequency int `json:"frequency,omitempty"`
+}
+
+// ScanResult is a network found by the last scan.
+type ScanResult struct {
+	BSSID     string `json:"BSSID"`
+	SSID      string `json:"SSID"`
+	Frequency int    `json:"frequency"`
+	Signal    int    `json:"signal"`
+	// Flags describe the security, such as "[WPA2-PSK-CCMP][ESS]".
+	Flags string `json:"flags"`
+}
+
+// Client controls wpa_supplicant, whose control interface works like
+// hostapd's.
+type Client struct {
+	ctrl *hostapd.Client
+}
+
+// NewClient connects to the control socket at sock, and publishes events
+// to events.
+func NewClient(sock string, events chan<- hostapd.Event) *Client {
+	return &Client{ctrl: hostapd.NewClient(sock, events)}
+}
+
+// Close disconnects from wpa_supplicant.
+func (c *Client) Close() error {
+	return c.ctrl.Close()
+}
+
+func (c *Client) expect(cmd, want string) error {
+	resp, err := c.ctrl.Request(cmd)
+	if err != nil {
+		return err
+	}
+	if r := strings.TrimSpace(string(resp)); r != want {
+		return errors.New("wpa_supplicant: " + cmd + ": " + r)
+	}
+	return nil
+}
+
+// RemoveNetworks removes every network.
+func (c *Client) RemoveNetworks() error {
+	return c.expect("REMOVE_NETWORK all", "OK")
+}
+
+// AddNetwork adds and enables a network, returning its ID.
+func (c *Client) AddNetwork(n *Network) (int, error) {
+	resp, err := c.ctrl.Request("ADD_NETWORK")
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.Atoi(strings.TrimSpace(string(resp)))
+	if err != nil {
+		return 0, fmt.Errorf("wpa_supplicant: ADD_NETWORK: %s", strings.TrimSpace(string(resp)))
+	}
+	if err := c.configureNetwork(id, n); err != nil {
+		c.RemoveNetwork(id)
+		return 0, err
+	}
+	return id, nil
+}
+
+func (c *Client) configureNetwork(id int, n *Network) error {
+	if strings.ContainsAny(n.Password, "\r\n\x00") {
+		return errors.New("password cannot contain line breaks")
+	}
+	set := func(key, value string) error {
+		return c.expect(fmt.Sprintf("SET_NETWORK %d %s %s", id, key, value), "OK")
+	}
+	// An unquoted SSID is read as hex, so it can contain anything.
+	if err := set("ssid", hex.EncodeToString([]byte(n.SSID))); err != nil {
+		return err
+	}
+	if n.Password == "" {
+		if err := set("key_mgmt", "NONE"); err != nil {
+			return err
+		}
+	} else {
+		// Not every build supports SAE (WPA3).
+		if err := set("key_mgmt", "WPA-PSK SAE"); err != nil {
+			if err := set("key_mgmt", "WPA-PSK"); err != nil {
+				return err
+			}
+		} else if err := set("ieee80211w", "1"); err != nil {
+			return err
+		}
+		// Quoted values run to the last quote, so the password can
+		// contain quotes itself.
+		if err := set("psk", `"`+n.Password+`"`); err != nil {
+			return err
+		}
+	}
+	if n.Hidden {
+		if err := set("scan_ssid", "1"); err != nil {
+			return err
+		}
+	}
+	if err := set("priority", strconv.Itoa(n.Priority)); err != nil {
+		return err
+	}
+	return c.expect(fmt.Sprintf("ENABLE_NETWORK %d", id), "OK")
+}
+
+// RemoveNetwork removes the network with the given ID.
+func (c *Client) RemoveNetwork(id int) error {
+	return c.expect(fmt.Sprintf("REMOVE_NETWORK %d", id), "OK")
+}
+
+// SelectNetwork connects to the network with the given ID, disabling the
+// others.
+func (c *Client) SelectNetwork(id int) error {
+	return c.expect(fmt.Sprintf("SELECT_NETWORK %d", id), "OK")
+}
+
+// EnableNetworks enables every network, so the best in range is joined.
+func (c *Client) EnableNetworks() error {
+	return c.expect("ENABLE_NETWORK all", "OK")
+}
+
+// Scan starts a scan. Results are announced with EventScanResults.
+func (c *Client) Scan() error {
+	resp, err := c.ctrl.Request("SCAN")
+	if err != nil {
+		return err
+	}
+	// A scan already in progress is as good as a new one.
+	if r := strings.TrimSpace(string(resp)); r != "OK" && r != "FAIL-BUSY" {
+		return errors.New("wpa_supplicant: SCAN: " + r)
+	}
+	return nil
+}
+
+// ScanResults returns the networks found by the last scan.
+func (c *Client) ScanResults() ([]ScanResult, error) {
+	resp, err := c.ctrl.Request("SCAN_RESULTS")
+	if err != nil {
+		return nil, err
+	}
+	return parseScanResults(string(resp)), nil
+}
+
+// parseScanResults parses the reply to SCAN_RESULTS, which starts with a
+// header line. Replies are limited to 4096 bytes, so the last line may be
+// cut short, and is then ignored.
+func parseScanResults(resp string) []ScanResult {
+	lines := strings.Split(resp, "\n")
+	out := []ScanResult{}
+	for i, line := range lines {
+		if i == 0 || line == "" {
+			continue
+		}
+		f := strings.Split(line, "\t")
+		if len(f) != 5 || (i == len(lines)-1 && !strings.HasSuffix(resp, "\n")) {
+			continue
+		}
+		freq, err1 := strconv.Atoi(f[1])
+		signal, err2 := strconv.Atoi(f[2])
+		if err1 != nil || err2 != nil {
+			continue
+		}
+		out = append(out, ScanResult{
+			BSSID:     f[0],
+			Frequency: freq,
+			Signal:    signal,
+			Flags:     f[3],
+			SSID:      unescape(f[4]),
+		})
+	}
+	return out
+}
+
+// Status returns the connection state.
+func (c *Client) Status() (*Status, error) {
+	resp, err := c.ctrl.Request("STATUS")
+	if err != nil {
+		return nil, err
+	}
+	out := &Status{}
+	for _, line := range strings.Split(string(resp), "\n") {
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "wpa_state":
+			out.State = kv[1]
+		case "ssid":
+			out.SSID = unescape(kv[1])
+		case "bssid":
+			out.BSSID = kv[1]
+		case "freq":
+			out.Frequency, _ = strconv.Atoi(kv[1])
+		}
+	}
+	if out.State == "" {
+		return nil, errors.New("wpa_supplicant: STATUS: no wpa_state")
+	}
+	return out, nil
+}
+
+// unescape decodes SSIDs, which wpa_supplicant escapes like C strings.
+func unescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'e':
+			out = append(out, 0x1b)
+		case 'x':
+			if i+2 < len(s) {
+				if b, err := strconv.ParseUint(s[i+1:i+3], 16, 8); err == nil {
+					out = append(out, byte(b))
+					i += 2
+					continue
+				}
+			}
+			out = append(out, '\\', 'x')
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return string(out)
+}
@@ -0,0 +1,76 @@
+package qrcode
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The matrices in testdata were made with an independent encoder, rsc.io/qr,
+// using the mask Encode chooses. Each covers a change in block structure.
+var encodeTests = []struct {
+	data   string
+	matrix string
+}{
+	// One block, no alignment patterns.
+	{`WIFI:S:home;;`, "v1.txt"},
+	// The first alignment pattern.
+	{`WIFI:T:WPA;S:home;P:pass;;`, "v2.txt"},
+	// Version information, and several alignment patterns.
+	{`WIFI:T:WPA;S:Hotel Lobby Guest Network;P:correct horse battery staple\; twice\, with a colon\: and more words;H:true;;`, "v7.txt"},
+	// Blocks of two different lengths.
+	{`WIFI:T:SAE;S:Upstairs \"Office\" 5GHz;P:Tr0ub4dor&3 is not a good passphrase\, but \\ it will do for a test of version eight;;`, "v8.txt"},
+	// A 16 bit character count.
+	{strings.Repeat("rnd ", 50), "v10.txt"},
+	// A third row of alignment patterns.
+	{strings.Repeat("0123456789", 35), "v14.txt"},
+}
+
+func TestEncode(t *testing.T) {
+	for _, tc := range encodeTests {
+		want, err := ioutil.ReadFile(filepath.Join("testdata", tc.matrix))
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, err := Encode([]byte(tc.data))
+		if err != nil {
+			t.Errorf("Encode(%q) failed: %v", tc.data, err)
+			continue
+		}
+		if got := matrix(c); !bytes.Equal(got, want) {
+			t.Errorf("Encode(%q) =\n%s\nwant (%s)\n%s", tc.data, got, tc.matrix, want)
+		}
+	}
+}
+
+func TestEncodeTooLong(t *testing.T) {
+	// Version 20 holds 666 bytes at level M.
+	c, err := Encode(make([]byte, 666))
+	if err != nil {
+		t.Fatalf("Encode(666 bytes) failed: %v", err)
+	}
+	if c.Size != 97 {
+		t.Errorf("Encode(666 bytes) has size %d, want 97", c.Size)
+	}
+	if _, err := Encode(make([]byte, 667)); err != ErrTooLong {
+		t.Errorf("Encode(667 bytes) returned %v, want ErrTooLong", err)
+	}
+}
+
+// matrix draws the code with # for dark modules and . for light ones.
+func matrix(c *Code) []byte {
+	var b bytes.Buffer
+	for y := 0; y < c.Size; y++ {
+		for x := 0; x < c.Size; x++ {
+			if c.Dark(x, y) {
+				b.WriteByte('#')
+			} else {
+				b.WriteByte('.')
+			}
+		}
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
@@ -91,3 +91,181 @@ app.controller('HomeController', ["$scope", "$http", "$rootScope", "$interval",
 
     $scope.loadStatus();
 }]);
+
+app.controller('OnboardingController', ["$scope", "$http", "$rootScope", function ($scope, $http, $rootScope) {
+    $scope.status = {};
+
+    $scope.loadStatus = function(){
+      $http({
+        method: 'GET',
+        url: '/status',
+      }).then(function successCallback(response) {
+        $scope.status = response.data;
+      });
+    }
+
+    $scope.startWPS = function(){
+      $http({
+        method: 'POST',
+        url: '/wifi/wps',
+      }).then($scope.loadStatus);
+    }
+
+    $scope.cancelWPS = function(){
+      $http({
+        method: 'POST',
+        url: '/wifi/wps/cancel',
+      }).then($scope.loadStatus);
+    }
+
+    $rootScope.$on('page-change', function(event, args) {
+      if (args.page == 'wifi')
+        $scope.loadStatus();
+    });
+}]);
+
+// apiToken holds the api_token, which is kept in this browser, for the
+// endpoints which need it.
+app.factory('apiToken', function(){
+    return {
+      token: localStorage.getItem('apiToken') || '',
+      save: function(){
+        localStorage.setItem('apiToken', this.token);
+      },
+      headers: function(){
+        return {Authorization: 'Bearer ' + this.token};
+      },
+    };
+});
+
+app.controller('TokenController', ["$scope", "$rootScope", "apiToken", function ($scope, $rootScope, apiToken) {
+    $scope.auth = apiToken;
+
+    $scope.saveToken = function(){
+      apiToken.save();
+      $rootScope.$broadcast('token-change');
+    }
+}]);
+
+app.controller('UplinkController', ["$scope", "$http", "$rootScope", "apiToken", function ($scope, $http, $rootScope, apiToken) {
+    $scope.uplink = null;
+    $scope.connectTo = null;
+
+    var authHeaders = function(){
+      return apiToken.headers();
+    }
+
+    $scope.loadUplink = function(){
+      $http({
+        method: 'GET',
+        url: '/uplink',
+      }).then(function successCallback(response) {
+        $scope.uplink = response.data;
+      });
+    }
+
+    $scope.scan = function(){
+      $http({
+        method: 'POST',
+        url: '/uplink/scan',
+        headers: authHeaders(),
+      }).then($scope.loadUplink, function errorCallback(response) {
+        $scope.error = response.data;
+      });
+    }
+
+    $scope.choose = function(ssid){
+      $scope.connectTo = {SSID: ssid, password: '', save: true};
+      $scope.error = null;
+    }
+
+    // select joins a known network, keeping its settings.
+    $scope.select = function(ssid){
+      $scope.connectTo = {SSID: ssid};
+      $scope.connect();
+    }
+
+    $scope.cancel = function(){
+      $scope.connectTo = null;
+    }
+
+    $scope.connect = function(){
+      $scope.error = null;
+      $http({
+        method: 'POST',
+        url: '/uplink/connect',
+        headers: authHeaders(),
+        data: $scope.connectTo,
+      }).then(function successCallback(response) {
+        $scope.connectTo = null;
+        $scope.loadUplink();
+      }, function errorCallback(response) {
+        $scope.error = response.data;
+      });
+    }
+
+    $scope.forget = function(ssid){
+      $http({
+        method: 'POST',
+        url: '/uplink/forget',
+        headers: authHeaders(),
+        data: {SSID: ssid},
+      }).then($scope.loadUplink, function errorCallback(response) {
+        $scope.error = response.data;
+      });
+    }
+
+    // auto goes back to joining any known network in range.
+    $scope.auto = function(){
+      $http({
+        method: 'POST',
+        url: '/uplink/auto',
+        headers: authHeaders(),
+      }).then($scope.loadUplink, function errorCallback(response) {
+        $scope.error = response.data;
+      });
+    }
+
+    $rootScope.$on('page-change', function(event, args) {
+      if (args.page == 'wifi')
+        $scope.loadUplink();
+    });
+}]);
+
+app.controller('CaptiveController', ["$scope", "$http", "$rootScope", "apiToken", function ($scope, $http, $rootScope, apiToken) {
+    $scope.clients = [];
+
+    $scope.loadClients = function(){
+      $http({
+        method: 'GET',
+        url: '/captive/clients',
+        headers: apiToken.headers(),
+      }).then(function successCallback(response) {
+        $scope.clients = response.data || [];
+      });
+    }
+
+    $scope.approve = function(mac){
+      $http({
+        method: 'POST',
+        url: '/captive/approve',
+        headers: apiToken.headers(),
+        data: {mac: mac},
+      }).then($scope.loadClients);
+    }
+
+    $scope.revoke = function(mac){
+      $http({
+        method: 'POST',
+        url: '/captive/revoke',
+        headers: apiToken.headers(),
+        data: {mac: mac},
+      }).then($scope.loadClients);
+    }
+
+    $rootScope.$on('page-change', function(event, args) {
+      if (args.page == 'wifi')
+        $scope.loadClients();
+    });
+    $rootScope.$on('token-change', $scope.loadClients);
+}]);